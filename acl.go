@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// proxyAcl is the parsed source address lists of a proxy
+type proxyAcl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parse cidr list, a plain ip is taken as a single host
+func parseCidrs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", s)
+		}
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+func newProxyAcl(allow []string, deny []string) (*proxyAcl, error) {
+	var acl = &proxyAcl{}
+	var err error
+
+	acl.allow, err = parseCidrs(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	acl.deny, err = parseCidrs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+func containsIp(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deny list is checked first, empty allow list allows all
+func (acl *proxyAcl) permit(addr net.Addr) bool {
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		//unix socket peers have no address
+		return true
+	}
+
+	if containsIp(acl.deny, ip) {
+		return false
+	}
+
+	if len(acl.allow) == 0 {
+		return true
+	}
+
+	return containsIp(acl.allow, ip)
+}
+
+// check source address of a new connection, count and log the denied
+func (pi *ProxyItem) checkAcl(addr net.Addr) bool {
+	if pi.permitAcl(addr) {
+		return true
+	}
+
+	log.Println("Denied connection from", addr.String(), "to proxy", pi.Id)
+	return false
+}
+
+// check source address, count the denied without logging
+func (pi *ProxyItem) permitAcl(addr net.Addr) bool {
+	if pi.acl == nil || pi.acl.permit(addr) {
+		return true
+	}
+
+	pi.stats.rejected.Add(1)
+	return false
+}
+
+// split comma separated list from form value
+func splitList(s string) []string {
+	var list []string
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	AGENT_MIN_BACKOFF  = time.Second
+	AGENT_MAX_BACKOFF  = time.Minute
+	AGENT_DIAL_TIMEOUT = 10 * time.Second
+)
+
+// AgentInfo is the status of a remote agent seen by the controller
+type AgentInfo struct {
+	Name    string
+	Online  bool
+	Addr    string //address the agent connected from
+	Since   string //online or offline since
+	Streams int
+	session *muxSession
+}
+
+type AgentList struct {
+	lock   sync.Mutex
+	agents map[string]*AgentInfo
+}
+
+var agents = &AgentList{agents: make(map[string]*AgentInfo)}
+
+// set agent online, false if an agent of the same name is still connected
+func (al *AgentList) online(name string, addr string, ms *muxSession) bool {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	ai, ok := al.agents[name]
+	if ok && ai.session != nil {
+		return false
+	}
+	if !ok {
+		ai = &AgentInfo{Name: name}
+		al.agents[name] = ai
+	}
+
+	ai.Online = true
+	ai.Addr = addr
+	ai.Since = time.Now().Format(time.RFC3339)
+	ai.session = ms
+	return true
+}
+
+func (al *AgentList) offline(name string, ms *muxSession) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	ai, ok := al.agents[name]
+	if !ok || ai.session != ms {
+		return
+	}
+
+	ai.Online = false
+	ai.Since = time.Now().Format(time.RFC3339)
+	ai.session = nil
+}
+
+func (al *AgentList) getSession(name string) *muxSession {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	ai, ok := al.agents[name]
+	if !ok {
+		return nil
+	}
+	return ai.session
+}
+
+// list known agents, include offline agents referred by proxies
+func (al *AgentList) list() []AgentInfo {
+	var list = []AgentInfo{}
+
+	al.lock.Lock()
+	for _, ai := range al.agents {
+		a := *ai
+		if a.session != nil {
+			a.Streams = a.session.streamCount()
+		}
+		list = append(list, a)
+	}
+	al.lock.Unlock()
+
+	for _, pi := range proxies.list() {
+		pi.lock.Lock()
+		name := pi.Agent
+		pi.lock.Unlock()
+
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, a := range list {
+			if a.Name == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			list = append(list, AgentInfo{Name: name})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// dial network addr through agent
+func dialViaAgent(name string, network string, addr string) (net.Conn, error) {
+	ms := agents.getSession(name)
+	if ms == nil {
+		return nil, fmt.Errorf("agent %s is offline", name)
+	}
+
+	return ms.open(network, addr)
+}
+
+// dial remote side of proxy, directly or through its agent
+func dialRemote(pi *ProxyItem) (net.Conn, error) {
+	if pi.Agent != "" {
+		return dialViaAgent(pi.Agent, pi.getRemoteType(), pi.getRemoteAddr())
+	}
+
+	return net.DialTimeout(pi.getRemoteType(), pi.getRemoteAddr(), AGENT_DIAL_TIMEOUT)
+}
+
+// role of agent connect, checked by -agentkey if set, otherwise an admin token is needed
+func agentRole() int {
+	if cfg.agentKey != "" {
+		return ROLE_NONE
+	}
+	return ROLE_ADMIN
+}
+
+// controller side, an agent connected to /ws?op=agent
+func doAgentConnect(resp http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("name")
+	if name == "" {
+		http.Error(resp, "Param name missing", http.StatusBadRequest)
+		return
+	}
+
+	if cfg.agentKey != "" {
+		if subtle.ConstantTimeCompare([]byte(req.FormValue("key")), []byte(cfg.agentKey)) != 1 {
+			log.Println("Agent", name, "from", req.RemoteAddr, "rejected: invalid key")
+			http.Error(resp, "Invalid agent key", http.StatusForbidden)
+			return
+		}
+	} else if !cfg.auth {
+		log.Println("Agent", name, "from", req.RemoteAddr, "rejected: no -agentkey set")
+		http.Error(resp, "Agents need -agentkey or login", http.StatusForbidden)
+		return
+	}
+
+	if agents.getSession(name) != nil {
+		log.Println("Agent", name, "from", req.RemoteAddr, "rejected: already online")
+		http.Error(resp, "Agent "+name+" already online", http.StatusConflict)
+		return
+	}
+
+	conn, _, _, err := ws.UpgradeHTTP(req, resp)
+	if err != nil {
+		fmt.Println("Failed to upgrade to websocket,", err, req)
+		return
+	}
+
+	ms := newMuxSession(conn, conn, false, name)
+	if !agents.online(name, req.RemoteAddr, ms) {
+		log.Println("Agent", name, "from", req.RemoteAddr, "rejected: already online")
+		conn.Close()
+		return
+	}
+	log.Println("Agent", name, "online from", req.RemoteAddr)
+
+	go func() {
+		err := ms.serve()
+		agents.offline(name, ms)
+		log.Println("Agent", name, "offline:", err)
+	}()
+}
+
+func agentListHandler(resp http.ResponseWriter, req *http.Request) {
+	j, err := json.Marshal(agents.list())
+	if err != nil {
+		fmt.Println("Failed to marshal agent list", err)
+		j = []byte("[]")
+	}
+
+	resp.Write(j)
+}
+
+// agent side, dial the target asked by controller and splice it with the stream
+func agentOpen(s *muxStream, network string, addr string) {
+	conn, err := net.DialTimeout(network, addr, AGENT_DIAL_TIMEOUT)
+	if err != nil {
+		fmt.Println("Agent failed to dial", network, addr, err)
+		s.session.writeFrame(MUX_OPEN_FAIL, s.id, []byte(err.Error()))
+		s.session.delStream(s)
+		return
+	}
+
+	err = s.session.writeFrame(MUX_OPEN_OK, s.id, nil)
+	if err != nil {
+		conn.Close()
+		s.Close()
+		return
+	}
+
+	log.Println("Agent connected to", conn.RemoteAddr().String())
+	spliceConn(s, conn)
+	log.Println("Agent connection to", addr, "closed")
+}
+
+// copy data between a and b until one side closed
+func spliceConn(a net.Conn, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	done := make(chan int, 2)
+
+	go func() {
+		io.Copy(a, b)
+		done <- 1
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- 2
+	}()
+
+	<-done
+}
+
+type agentRW struct {
+	io.Reader
+	io.Writer
+}
+
+func getAgentUrl() (string, error) {
+	rawUrl := cfg.agentUrl
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "ws://" + rawUrl
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+
+	q := u.Query()
+	q.Set("op", "agent")
+	q.Set("name", cfg.agentName)
+	if cfg.agentKey != "" {
+		q.Set("key", cfg.agentKey)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// connect to controller once, return when the link is broken
+func agentOnce(agentUrl string) error {
+	tc, err := getAgentTlsConfig()
+	if err != nil {
+		return err
+	}
+
+	var d = ws.Dialer{TLSConfig: tc}
+	if cfg.agentToken != "" {
+		d.Header = ws.HandshakeHeaderHTTP(http.Header{"Authorization": []string{"Bearer " + cfg.agentToken}})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AGENT_DIAL_TIMEOUT)
+	conn, br, _, err := d.Dial(ctx, agentUrl)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	var rd io.ReadWriter = conn
+	if br != nil {
+		rd = &agentRW{br, conn}
+		defer ws.PutReader(br)
+	}
+
+	log.Println("Agent", cfg.agentName, "connected to controller", conn.RemoteAddr().String())
+	ms := newMuxSession(conn, rd, true, cfg.agentName)
+	ms.onOpen = agentOpen
+	return ms.serve()
+}
+
+// run as agent, keep the control link to controller with backoff
+func runAgent() {
+	if cfg.agentName == "" {
+		cfg.agentName, _ = os.Hostname()
+	}
+
+	agentUrl, err := getAgentUrl()
+	if err != nil {
+		log.Println("Invalid controller url", cfg.agentUrl, err)
+		return
+	}
+
+	backoff := AGENT_MIN_BACKOFF
+	for {
+		begin := time.Now()
+		err := agentOnce(agentUrl)
+		log.Println("Agent link to controller closed:", err)
+
+		if time.Since(begin) > AGENT_MAX_BACKOFF {
+			backoff = AGENT_MIN_BACKOFF
+		}
+
+		log.Println("Reconnecting in", backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > AGENT_MAX_BACKOFF {
+			backoff = AGENT_MAX_BACKOFF
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// max size of request body of v2 api
+const API_MAX_BODY = 1 << 20
+
+// error codes of v2 api
+const (
+	API_ERR_BAD_REQUEST    = "bad_request"
+	API_ERR_INVALID_PARAM  = "invalid_param"
+	API_ERR_NOT_FOUND      = "not_found"
+	API_ERR_NOT_ALLOWED    = "method_not_allowed"
+	API_ERR_UNAUTHORIZED   = "unauthorized"
+	API_ERR_FORBIDDEN      = "forbidden"
+	API_ERR_START_FAILED   = "start_failed"
+	API_ERR_INTERNAL_ERROR = "internal_error"
+)
+
+type apiError struct {
+	Code    string
+	Message string
+}
+
+// error envelope of all v2 api errors
+type apiErrorRsp struct {
+	Error apiError
+}
+
+// response of start, stop and restart
+type apiActionRsp struct {
+	Proxy   *ProxyItem
+	Drained int //sessions finished during stop
+	Killed  int //sessions closed by stop
+}
+
+func isApiPath(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+func writeApiJson(resp http.ResponseWriter, status int, v any) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Failed to marshal api response:", err)
+		status = http.StatusInternalServerError
+		j, _ = json.Marshal(apiErrorRsp{apiError{API_ERR_INTERNAL_ERROR, err.Error()}})
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(j)
+}
+
+func writeApiError(resp http.ResponseWriter, status int, code string, msg string) {
+	writeApiJson(resp, status, apiErrorRsp{apiError{code, msg}})
+}
+
+// get proxy by path id, write 404 if not found
+func apiGetPathProxy(resp http.ResponseWriter, req *http.Request) *ProxyItem {
+	id := req.PathValue("id")
+	pi, _ := proxies.get(id)
+	if pi == nil {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "Proxy "+id+" not found")
+	}
+	return pi
+}
+
+// decode json body into v, write 400 on failure
+func apiDecodeBody(resp http.ResponseWriter, req *http.Request, v any) bool {
+	defer req.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, API_MAX_BODY))
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_BAD_REQUEST, "Invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// validate new config then apply it, write error or the updated proxy
+func apiModifyProxy(resp http.ResponseWriter, newp *ProxyItem) {
+	newp.addDefaults()
+	err := newp.checkParam(true)
+	if err != nil {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, strings.TrimSpace(err.Error()))
+		return
+	}
+
+	pi, _ := proxies.getN(newp.Id)
+	err = proxies.modify(newp)
+	if err != nil {
+		writeApiError(resp, http.StatusConflict, API_ERR_START_FAILED, err.Error())
+		return
+	}
+	writeApiJson(resp, http.StatusOK, pi)
+}
+
+func apiNotFoundHandler(resp http.ResponseWriter, req *http.Request) {
+	writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "No such api: "+req.URL.Path)
+}
+
+// /api/v2/proxies
+func apiProxiesHandler(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		f, err := parseProxyFilter(req.URL.Query())
+		if err != nil {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, err.Error())
+			return
+		}
+		var list = proxies.filter(f)
+		if list == nil {
+			list = []*ProxyItem{}
+		}
+		writeApiJson(resp, http.StatusOK, list)
+	case http.MethodPost:
+		var body ProxyItem
+		if !apiDecodeBody(resp, req, &body) {
+			return
+		}
+
+		//only take config attributes from request
+		var pi = &ProxyItem{}
+		updateProxy(pi, &body)
+		updateAttrs(pi, &body)
+		pi.addDefaults()
+		err := pi.checkParam(false)
+		if err != nil {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, strings.TrimSpace(err.Error()))
+			return
+		}
+
+		id := proxies.add(pi)
+		resp.Header().Set("Location", fmt.Sprintf("/api/v2/proxies/%d", id))
+		writeApiJson(resp, http.StatusCreated, pi)
+	}
+}
+
+// /api/v2/proxies/{id}
+func apiProxyHandler(resp http.ResponseWriter, req *http.Request) {
+	pi := apiGetPathProxy(resp, req)
+	if pi == nil {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeApiJson(resp, http.StatusOK, pi)
+	case http.MethodPut:
+		//replace whole config, missing attributes are reset
+		var newp = &ProxyItem{}
+		if !apiDecodeBody(resp, req, newp) {
+			return
+		}
+		newp.Id = pi.Id
+		apiModifyProxy(resp, newp)
+	case http.MethodPatch:
+		//merge attributes in request into current config
+		newp := pi.config()
+		if !apiDecodeBody(resp, req, newp) {
+			return
+		}
+		newp.Id = pi.Id
+		apiModifyProxy(resp, newp)
+	case http.MethodDelete:
+		err := proxies.del(strconv.Itoa(pi.Id))
+		if err != nil {
+			writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, err.Error())
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// /api/v2/proxies/{id}/start, stop and restart
+func apiProxyActionHandler(action string) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		pi := apiGetPathProxy(resp, req)
+		if pi == nil {
+			return
+		}
+
+		var rsp = apiActionRsp{Proxy: pi}
+		var err error
+		switch action {
+		case "start":
+			err = pi.start()
+		case "stop":
+			rsp.Drained, rsp.Killed = pi.stop()
+		case "restart":
+			err = pi.restart()
+		}
+
+		if err != nil {
+			writeApiError(resp, http.StatusConflict, API_ERR_START_FAILED, err.Error())
+			return
+		}
+		writeApiJson(resp, http.StatusOK, rsp)
+	}
+}
+
+// /api/v2/proxies/{id}/connections
+func apiConnsHandler(resp http.ResponseWriter, req *http.Request) {
+	pi := apiGetPathProxy(resp, req)
+	if pi == nil {
+		return
+	}
+	writeApiJson(resp, http.StatusOK, pi.getConnInfos())
+}
+
+// /api/v2/proxies/{id}/connections/{conn}
+func apiConnHandler(resp http.ResponseWriter, req *http.Request) {
+	pi := apiGetPathProxy(resp, req)
+	if pi == nil {
+		return
+	}
+
+	connId, err := strconv.Atoi(req.PathValue("conn"))
+	if err != nil || !pi.killConn(connId) {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "Connection "+req.PathValue("conn")+" not found")
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// /api/v2/config/save
+func apiSaveHandler(resp http.ResponseWriter, req *http.Request) {
+	err := proxies.save(cfg.cfgFile)
+	if err != nil {
+		writeApiError(resp, http.StatusInternalServerError, API_ERR_INTERNAL_ERROR, err.Error())
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// apiRoute is a documented api route, all of them are described in openapi.json
+type apiRoute struct {
+	Path    string
+	Methods []string
+	Role    func(*http.Request) int
+	Handler http.HandlerFunc
+}
+
+// role required by v2 api, reading needs viewer
+func apiRole(write int) func(*http.Request) int {
+	return func(req *http.Request) int {
+		if req.Method == http.MethodGet {
+			return ROLE_VIEWER
+		}
+		return write
+	}
+}
+
+func getApiRoutes() []apiRoute {
+	return []apiRoute{
+		{"/api/openapi.json", []string{"GET"}, needRole(ROLE_NONE), openApiHandler},
+		{"/lcx/login", []string{"POST"}, needRole(ROLE_NONE), loginHandler},
+		{"/lcx/logout", []string{"GET", "POST"}, needRole(ROLE_NONE), logoutHandler},
+		{"/lcx/whoami", []string{"GET"}, needRole(ROLE_VIEWER), whoamiHandler},
+		{"/api/v2/proxies", []string{"GET", "POST"}, apiRole(ROLE_ADMIN), apiProxiesHandler},
+		{"/api/v2/proxies/{id}", []string{"GET", "PUT", "PATCH", "DELETE"}, apiRole(ROLE_ADMIN), apiProxyHandler},
+		{"/api/v2/proxies/{id}/start", []string{"POST"}, needRole(ROLE_OPERATOR), apiProxyActionHandler("start")},
+		{"/api/v2/proxies/{id}/stop", []string{"POST"}, needRole(ROLE_OPERATOR), apiProxyActionHandler("stop")},
+		{"/api/v2/proxies/{id}/restart", []string{"POST"}, needRole(ROLE_OPERATOR), apiProxyActionHandler("restart")},
+		{"/api/v2/proxies/{id}/connections", []string{"GET"}, needRole(ROLE_VIEWER), apiConnsHandler},
+		{"/api/v2/proxies/{id}/connections/{conn}", []string{"DELETE"}, needRole(ROLE_OPERATOR), apiConnHandler},
+		{"/api/v2/bulk/start", []string{"POST"}, needRole(ROLE_OPERATOR), apiBulkHandler("start")},
+		{"/api/v2/bulk/stop", []string{"POST"}, needRole(ROLE_OPERATOR), apiBulkHandler("stop")},
+		{"/api/v2/bulk/restart", []string{"POST"}, needRole(ROLE_OPERATOR), apiBulkHandler("restart")},
+		{"/api/v2/bulk/delete", []string{"POST"}, needRole(ROLE_ADMIN), apiBulkHandler("delete")},
+		{"/api/v2/bulk/modify", []string{"POST"}, needRole(ROLE_ADMIN), apiBulkHandler("modify")},
+		{"/api/v2/sshkeys", []string{"GET", "POST"}, needRole(ROLE_OPERATOR), apiSshKeysHandler},
+		{"/api/v2/sshkeys/{id}", []string{"DELETE"}, needRole(ROLE_OPERATOR), apiSshKeyHandler},
+		{"/api/v2/hostkeys", []string{"GET"}, needRole(ROLE_VIEWER), apiHostKeysHandler},
+		{"/api/v2/hostkeys/pending", []string{"GET"}, needRole(ROLE_VIEWER), apiHostKeyPendingHandler},
+		{"/api/v2/hostkeys/pending/{id}/accept", []string{"POST"}, needRole(ROLE_ADMIN), apiHostKeyResolveHandler(true)},
+		{"/api/v2/hostkeys/pending/{id}/reject", []string{"POST"}, needRole(ROLE_ADMIN), apiHostKeyResolveHandler(false)},
+		{"/api/v2/recordings", []string{"GET"}, needRole(ROLE_VIEWER), apiRecordingsHandler},
+		{"/api/v2/recordings/{id}", []string{"GET", "DELETE"}, apiRole(ROLE_ADMIN), apiRecordingHandler},
+		{"/api/v2/sessions", []string{"GET"}, needRole(ROLE_OPERATOR), apiSessionsHandler},
+		{"/api/v2/sessions/{id}", []string{"GET"}, needRole(ROLE_OPERATOR), apiSessionHandler},
+		{"/api/v2/sessions/{id}/observers/{observer}", []string{"DELETE"}, needRole(ROLE_OPERATOR), apiSessionObserverHandler},
+		{"/api/v2/events", []string{"GET"}, needRole(ROLE_VIEWER), eventsHandler},
+		{"/api/v2/config/save", []string{"POST"}, needRole(ROLE_ADMIN), apiSaveHandler},
+		{"/lcx/export", []string{"GET"}, needRole(ROLE_VIEWER), exportHandler},
+		{"/lcx/import", []string{"POST"}, needRole(ROLE_ADMIN), importHandler},
+	}
+}
+
+// reject methods not in route before checking auth
+func (r apiRoute) handle(resp http.ResponseWriter, req *http.Request) {
+	if !slices.Contains(r.Methods, req.Method) {
+		resp.Header().Set("Allow", strings.Join(r.Methods, ", "))
+		if isApiPath(req.URL.Path) {
+			writeApiError(resp, http.StatusMethodNotAllowed, API_ERR_NOT_ALLOWED, "Method not allowed: "+req.Method)
+		} else {
+			http.Error(resp, "Method not support: "+req.Method, http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	authWrap(r.Role, r.Handler)(resp, req)
+}
+
+func registerApi(mux *http.ServeMux) {
+	mux.HandleFunc("/api/", apiNotFoundHandler)
+	for _, r := range getApiRoutes() {
+		mux.HandleFunc(r.Path, r.handle)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// roles, a higher role has all rights of the lower ones
+const (
+	ROLE_NONE int = iota
+	ROLE_VIEWER
+	ROLE_OPERATOR //start, stop, terminal
+	ROLE_ADMIN
+)
+
+const (
+	SESSION_COOKIE  = "lcx_session"
+	SESSION_TIMEOUT = 12 * time.Hour
+)
+
+var roleNames = map[string]int{
+	"viewer":   ROLE_VIEWER,
+	"operator": ROLE_OPERATOR,
+	"admin":    ROLE_ADMIN,
+}
+
+// UserCfg is a local user saved in users file
+type UserCfg struct {
+	Name     string
+	Role     string   //admin, operator, viewer
+	Password string   //bcrypt hash
+	Tokens   []string //sha256 of api tokens
+}
+
+type authUser struct {
+	Name string
+	Role string
+}
+
+func (u *authUser) roleLevel() int {
+	return roleNames[u.Role]
+}
+
+type authSession struct {
+	user   authUser
+	expire time.Time
+}
+
+type AuthMgr struct {
+	lock     sync.Mutex
+	fileName string
+	users    []*UserCfg
+	sessions map[string]*authSession
+}
+
+var auth = &AuthMgr{sessions: make(map[string]*authSession)}
+
+type ctxKey int
+
+const userCtxKey ctxKey = 0
+
+func randToken() string {
+	var b = make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (am *AuthMgr) load(fileName string) error {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	am.fileName = fileName
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, &am.users)
+}
+
+// reload users file changed by -useradd or -tokenadd, on SIGHUP.
+// sessions of removed users or changed passwords are revoked, others get the new role
+func (am *AuthMgr) reload() error {
+	buf, err := os.ReadFile(am.fileName)
+	if err != nil {
+		return err
+	}
+	var users []*UserCfg
+	err = json.Unmarshal(buf, &users)
+	if err != nil {
+		return err
+	}
+
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	var old = make(map[string]string)
+	for _, u := range am.users {
+		old[u.Name] = u.Password
+	}
+	am.users = users
+
+	var revoked int
+	for token, s := range am.sessions {
+		u := am.getUser(s.user.Name)
+		if u == nil || u.Password != old[u.Name] {
+			delete(am.sessions, token)
+			revoked++
+			continue
+		}
+		s.user.Role = u.Role
+	}
+	log.Println("Reloaded users file", am.fileName+",", revoked, "sessions revoked")
+	return nil
+}
+
+func (am *AuthMgr) save() error {
+	j, err := json.MarshalIndent(am.users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(am.fileName, j, 0600)
+}
+
+func (am *AuthMgr) getUser(name string) *UserCfg {
+	for _, u := range am.users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// add or update a user, password is not changed if empty
+func (am *AuthMgr) setUser(name string, role string, password string) error {
+	if _, ok := roleNames[role]; !ok {
+		return fmt.Errorf("unknown role %s", role)
+	}
+
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	u := am.getUser(name)
+	if u == nil {
+		if password == "" {
+			return fmt.Errorf("password of new user %s is empty", name)
+		}
+		u = &UserCfg{Name: name}
+		am.users = append(am.users, u)
+	}
+
+	u.Role = role
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		u.Password = string(hash)
+	}
+
+	return am.save()
+}
+
+// create an api token for user, only its hash is saved
+func (am *AuthMgr) addToken(name string) (string, error) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	u := am.getUser(name)
+	if u == nil {
+		return "", fmt.Errorf("user %s not exist", name)
+	}
+
+	token := randToken()
+	u.Tokens = append(u.Tokens, hashToken(token))
+	return token, am.save()
+}
+
+func (am *AuthMgr) login(name string, password string) (string, *authUser, error) {
+	am.lock.Lock()
+	u := am.getUser(name)
+	var hash string
+	var user authUser
+	if u != nil {
+		hash = u.Password
+		user = authUser{u.Name, u.Role}
+	}
+	am.lock.Unlock()
+
+	if u == nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", nil, fmt.Errorf("invalid user or password")
+	}
+
+	token := randToken()
+	am.lock.Lock()
+	am.sessions[token] = &authSession{user, time.Now().Add(SESSION_TIMEOUT)}
+	am.lock.Unlock()
+
+	return token, &user, nil
+}
+
+func (am *AuthMgr) logout(token string) {
+	am.lock.Lock()
+	delete(am.sessions, token)
+	am.lock.Unlock()
+}
+
+// find user by session token or api token
+func (am *AuthMgr) checkToken(token string) *authUser {
+	if token == "" {
+		return nil
+	}
+
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	s, ok := am.sessions[token]
+	if ok {
+		if time.Now().After(s.expire) {
+			delete(am.sessions, token)
+			return nil
+		}
+		user := s.user
+		return &user
+	}
+
+	hash := hashToken(token)
+	for _, u := range am.users {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(hash)) == 1 {
+				return &authUser{u.Name, u.Role}
+			}
+		}
+	}
+
+	return nil
+}
+
+func getReqToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+
+	c, err := req.Cookie(SESSION_COOKIE)
+	if err == nil {
+		return c.Value
+	}
+
+	return ""
+}
+
+// get user of request, nil if auth is disabled
+func getReqUser(req *http.Request) *authUser {
+	u, _ := req.Context().Value(userCtxKey).(*authUser)
+	return u
+}
+
+// get user name of request for logs and records
+func getReqUserName(req *http.Request) string {
+	u := getReqUser(req)
+	if u == nil {
+		return "anonymous"
+	}
+	return u.Name
+}
+
+func needRole(role int) func(*http.Request) int {
+	return func(*http.Request) int {
+		return role
+	}
+}
+
+func authError(resp http.ResponseWriter, req *http.Request, status int) {
+	if status == http.StatusUnauthorized && isUiPage(req.URL.Path) {
+		http.Redirect(resp, req, "/login.html", http.StatusFound)
+		return
+	}
+	if !isApiPath(req.URL.Path) {
+		http.Error(resp, http.StatusText(status), status)
+		return
+	}
+
+	code := API_ERR_UNAUTHORIZED
+	if status == http.StatusForbidden {
+		code = API_ERR_FORBIDDEN
+	}
+	writeApiError(resp, status, code, http.StatusText(status))
+}
+
+// check the role required by handler before calling it
+func authWrap(need func(*http.Request) int, h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !cfg.auth {
+			h(resp, req)
+			return
+		}
+
+		role := need(req)
+		if role == ROLE_NONE {
+			h(resp, req)
+			return
+		}
+
+		u := auth.checkToken(getReqToken(req))
+		if u == nil {
+			authError(resp, req, http.StatusUnauthorized)
+			return
+		}
+
+		if u.roleLevel() < role {
+			log.Println("User", u.Name, "denied to access", req.URL.String())
+			authError(resp, req, http.StatusForbidden)
+			return
+		}
+
+		h(resp, req.WithContext(context.WithValue(req.Context(), userCtxKey, u)))
+	}
+}
+
+// role required by multiplexed handlers, by op param
+func lcxRole(req *http.Request) int {
+	switch req.FormValue("op") {
+	case "save":
+		return ROLE_ADMIN
+	}
+	return ROLE_VIEWER
+}
+
+func lcxProxyRole(req *http.Request) int {
+	if req.Method == "DEL" {
+		return ROLE_ADMIN
+	}
+
+	switch req.FormValue("op") {
+	case "start", "stop":
+		return ROLE_OPERATOR
+	}
+	return ROLE_VIEWER
+}
+
+func lcxProxyOpRole(req *http.Request) int {
+	switch req.FormValue("op") {
+	case "start", "stop":
+		return ROLE_OPERATOR
+	}
+	return ROLE_ADMIN
+}
+
+func lcxProxyConnsRole(req *http.Request) int {
+	switch req.FormValue("op") {
+	case "":
+		return ROLE_VIEWER
+	}
+	return ROLE_OPERATOR
+}
+
+func websocketRole(req *http.Request) int {
+	switch req.FormValue("op") {
+	case "agent":
+		return agentRole()
+	case "termconnect":
+		return ROLE_OPERATOR
+	}
+	return ROLE_VIEWER
+}
+
+type loginReq struct {
+	Name     string
+	Password string
+}
+
+type loginRsp struct {
+	Name  string
+	Role  string
+	Token string
+}
+
+func loginHandler(resp http.ResponseWriter, req *http.Request) {
+	var lr loginReq
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(req.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &lr)
+		}
+		if err != nil {
+			http.Error(resp, "Invalid login request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		lr.Name = req.FormValue("name")
+		lr.Password = req.FormValue("password")
+	}
+
+	token, u, err := auth.login(lr.Name, lr.Password)
+	if err != nil {
+		log.Println("Login failed for user", lr.Name, "from", req.RemoteAddr)
+		http.Error(resp, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	log.Println("User", u.Name, "logged in from", req.RemoteAddr)
+	http.SetCookie(resp, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(SESSION_TIMEOUT.Seconds()),
+	})
+
+	j, _ := json.Marshal(loginRsp{u.Name, u.Role, token})
+	resp.Write(j)
+}
+
+func logoutHandler(resp http.ResponseWriter, req *http.Request) {
+	auth.logout(getReqToken(req))
+	http.SetCookie(resp, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1})
+	resp.Write([]byte("OK"))
+}
+
+func whoamiHandler(resp http.ResponseWriter, req *http.Request) {
+	var u = &authUser{"anonymous", "admin"}
+	if cfg.auth {
+		u = getReqUser(req)
+	}
+
+	j, _ := json.Marshal(u)
+	resp.Write(j)
+}
+
+// load users, create an admin with random password on first start
+func initAuth() {
+	err := auth.load(cfg.usersFile)
+	if err == nil {
+		return
+	}
+
+	if !os.IsNotExist(err) {
+		log.Fatalln("Failed to load users file", cfg.usersFile, err)
+	}
+
+	password := randToken()[:16]
+	err = auth.setUser("admin", "admin", password)
+	if err != nil {
+		log.Fatalln("Failed to create users file", cfg.usersFile, err)
+	}
+	log.Println("Created users file", cfg.usersFile, "with user admin, password:", password)
+}
+
+// handle -useradd and -tokenadd, return true if handled
+func userCmd() bool {
+	if cfg.userAdd == "" && cfg.tokenAdd == "" {
+		return false
+	}
+
+	err := auth.load(cfg.usersFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("Failed to load users file", cfg.usersFile, err)
+	}
+
+	if cfg.userAdd != "" {
+		fmt.Print("Password (empty to keep): ")
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		err = auth.setUser(cfg.userAdd, cfg.userRole, strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			log.Fatalln("Failed to set user", cfg.userAdd, err)
+		}
+		fmt.Println("User", cfg.userAdd, "saved with role", cfg.userRole+", send SIGHUP to a running server to reload users")
+	}
+
+	if cfg.tokenAdd != "" {
+		token, err := auth.addToken(cfg.tokenAdd)
+		if err != nil {
+			log.Fatalln("Failed to add token", err)
+		}
+		fmt.Println("API token of", cfg.tokenAdd+":", token)
+		fmt.Println("Send SIGHUP to a running server to reload users")
+	}
+
+	return true
+}
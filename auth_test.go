@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// tokens added by another process work after reload, sessions follow role changes
+func TestAuthReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "users.json")
+	am := &AuthMgr{fileName: fileName, sessions: make(map[string]*authSession)}
+	err := am.setUser("op", "operator", "pw1")
+	if err == nil {
+		err = am.setUser("gone", "viewer", "pw2")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	opSession, _, err := am.login("op", "pw1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goneSession, _, _ := am.login("gone", "pw2")
+
+	//-tokenadd and -useradd of another process
+	other := &AuthMgr{sessions: make(map[string]*authSession)}
+	other.load(fileName)
+	token, err := other.addToken("op")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.users = other.users[:1]
+	other.setUser("op", "admin", "")
+
+	if am.checkToken(token) != nil {
+		t.Fatal("token known before reload")
+	}
+	err = am.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := am.checkToken(token); u == nil || u.Role != "admin" {
+		t.Fatalf("token after reload: %v", u)
+	}
+	if u := am.checkToken(opSession); u == nil || u.Role != "admin" {
+		t.Fatalf("session role not updated: %v", u)
+	}
+	if am.checkToken(goneSession) != nil {
+		t.Fatal("session of removed user not revoked")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// version of config file format
+//
+//	1: bare array of proxies
+//	2: object with Version and Proxies
+const CONFIG_VERSION = 2
+
+// wait for more changes before autosave
+const AUTOSAVE_DELAY = 500 * time.Millisecond
+
+type proxyConfig struct {
+	Version int
+	Proxies []*ProxyItem
+}
+
+// configMigrations[n] converts config of version n to version n+1
+var configMigrations = map[int]func([]byte) ([]byte, error){
+	1: migrateConfigV1,
+}
+
+func migrateConfigV1(buf []byte) ([]byte, error) {
+	var items []json.RawMessage
+	err := json.Unmarshal(buf, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		Version int
+		Proxies []json.RawMessage
+	}{2, items})
+}
+
+func getConfigVersion(buf []byte) (int, error) {
+	buf = bytes.TrimSpace(buf)
+	if len(buf) > 0 && buf[0] == '[' {
+		return 1, nil
+	}
+
+	var v struct{ Version int }
+	err := json.Unmarshal(buf, &v)
+	if err != nil {
+		return 0, err
+	}
+	if v.Version <= 0 {
+		return 0, fmt.Errorf("no config version")
+	}
+	return v.Version, nil
+}
+
+// parse config of any known version, return proxies and the original version
+func parseConfig(buf []byte) ([]*ProxyItem, int, error) {
+	version, err := getConfigVersion(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > CONFIG_VERSION {
+		return nil, version, fmt.Errorf("config version %d is newer than %d", version, CONFIG_VERSION)
+	}
+
+	for v := version; v < CONFIG_VERSION; v++ {
+		buf, err = configMigrations[v](buf)
+		if err != nil {
+			return nil, version, fmt.Errorf("failed to migrate config from version %d: %v", v, err)
+		}
+	}
+
+	var pc proxyConfig
+	err = json.Unmarshal(buf, &pc)
+	if err != nil {
+		return nil, version, err
+	}
+	return pc.Proxies, version, nil
+}
+
+// attributes of running state, not saved in config
+var runtimeAttrs = []string{"Status", "Instances", "LastError"}
+
+// remove keys from json object, keep the order of the others
+func stripJsonKeys(buf []byte, keys []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('{') {
+		return nil, fmt.Errorf("not a json object")
+	}
+
+	var out = []byte{'{'}
+	for dec.More() {
+		t, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v json.RawMessage
+		err = dec.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+
+		k, _ := t.(string)
+		if slices.Contains(keys, k) {
+			continue
+		}
+		if len(out) > 1 {
+			out = append(out, ',')
+		}
+		kj, _ := json.Marshal(k)
+		out = append(out, kj...)
+		out = append(out, ':')
+		out = append(out, v...)
+	}
+	return append(out, '}'), nil
+}
+
+func (pl *ProxyList) encodeConfig(format string) ([]byte, error) {
+	var items = []json.RawMessage{}
+	for _, p := range pl.list() {
+		j, err := stripJsonKeys(p.ToJson(), runtimeAttrs)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, j)
+	}
+
+	buf, err := json.MarshalIndent(struct {
+		Version int
+		Proxies []json.RawMessage
+	}{CONFIG_VERSION, items}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return fromJson(buf, format)
+}
+
+// parse config file content of format
+func parseConfigAs(buf []byte, format string) ([]*ProxyItem, int, error) {
+	jbuf, err := toJson(buf, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseConfig(jbuf)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// keep n backups, fileName.1 is the newest
+func rotateBackups(fileName string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return nil
+	}
+
+	os.Remove(fileName + "." + strconv.Itoa(n))
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(fileName+"."+strconv.Itoa(i), fileName+"."+strconv.Itoa(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	//link keeps the current file in place until it is replaced
+	err := os.Link(fileName, fileName+".1")
+	if err != nil {
+		err = copyFile(fileName, fileName+".1")
+	}
+	return err
+}
+
+// write to a temp file then rename it over fileName, a crash leaves either the old or new file
+func writeFileAtomic(fileName string, data []byte, backups int, perm os.FileMode) error {
+	dir := filepath.Dir(fileName)
+	f, err := os.CreateTemp(dir, filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = rotateBackups(fileName, backups)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (pl *ProxyList) save(fileName string) error {
+	pl.saveLock.Lock()
+	defer pl.saveLock.Unlock()
+
+	if pl.readOnly {
+		return fmt.Errorf("config %s was not loaded, refuse to overwrite it", fileName)
+	}
+
+	data, err := pl.encodeConfig(getCfgFormat(fileName))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, pl.lastSaved) {
+		return nil
+	}
+
+	err = writeFileAtomic(fileName, data, cfg.backups, 0644)
+	if err != nil {
+		fmt.Println("Failed to save config", fileName, err)
+		return err
+	}
+
+	pl.lastSaved = data
+	fmt.Println("Config ", fileName, " saved")
+	return nil
+}
+
+// schedule a save after config changed
+func (pl *ProxyList) changed() {
+	if !cfg.autoSave || pl.cfgFile == "" {
+		return
+	}
+
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	if pl.saveTimer == nil {
+		pl.saveTimer = time.AfterFunc(AUTOSAVE_DELAY, pl.autoSave)
+	}
+}
+
+func (pl *ProxyList) autoSave() {
+	pl.lock.Lock()
+	pl.saveTimer = nil
+	pl.lock.Unlock()
+
+	pl.save(pl.cfgFile)
+}
+
+// save pending changes now, used before exit
+func (pl *ProxyList) flushSave() {
+	pl.lock.Lock()
+	pending := pl.saveTimer != nil && pl.saveTimer.Stop()
+	pl.saveTimer = nil
+	pl.lock.Unlock()
+
+	if pending {
+		pl.save(pl.cfgFile)
+	}
+}
+
+func (pl *ProxyList) loadCfg(fileName string, autostart bool) {
+	pl.cfgFile = fileName
+
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Failed to open file", fileName, "for read:", err)
+			pl.readOnly = true
+		}
+		return
+	}
+
+	items, version, err := parseConfigAs(buf, getCfgFormat(fileName))
+	if err != nil {
+		log.Println("Failed to load config", fileName, err, ", changes will not be saved")
+		pl.readOnly = true
+		return
+	}
+	pl.lastSaved = buf
+
+	pl.lock.Lock()
+	for _, p := range items {
+		if p.Id > pl.maxId {
+			pl.maxId = p.Id
+		}
+	}
+	var newIds int
+	for _, p := range items {
+		//hand written entries may have no id
+		if p.Id <= 0 || pl.pmap[p.Id] != nil {
+			p.Id = pl.allocId()
+			newIds++
+		}
+		p.Status = 0
+		p.Instances = 0
+		p.addDefaults()
+		p.mgr = pl
+		pl.pmap[p.Id] = p
+	}
+	pl.lock.Unlock()
+
+	if version < CONFIG_VERSION {
+		log.Println("Migrating config", fileName, "from version", version, "to", CONFIG_VERSION)
+		pl.save(fileName)
+	} else if newIds > 0 {
+		log.Println("Assigned ids to", newIds, "proxies without unique id in config", fileName)
+		pl.save(fileName)
+	}
+
+	if autostart {
+		for _, p := range items {
+			err = p.start()
+			if err != nil {
+				log.Println("Failed to start proxy", p, ", err:", err)
+			}
+		}
+	}
+}
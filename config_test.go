@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadCfgAssignIds(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "proxy.yaml")
+	err := os.WriteFile(fileName, []byte(`Version: 2
+Proxies:
+  - Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10001
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+  - Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10002
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+  - Id: 5
+    Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10003
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := newTestProxyList(t)
+	cfg.backups = 0
+	pl.loadCfg(fileName, false)
+	if ports := proxyPorts(pl); !slices.Equal(ports, []int{10001, 10002, 10003}) {
+		t.Fatalf("unexpected proxies %v", ports)
+	}
+	if p, _ := pl.getN(5); p == nil || p.LocalPort != 10003 {
+		t.Fatal("proxy 5 lost its id")
+	}
+
+	//ids are saved, runtime attributes are not
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Id: 6", "Id: 7"} {
+		if !strings.Contains(string(buf), s) {
+			t.Fatalf("%s not saved:\n%s", s, buf)
+		}
+	}
+	for _, s := range runtimeAttrs {
+		if strings.Contains(string(buf), s+":") {
+			t.Fatalf("%s saved:\n%s", s, buf)
+		}
+	}
+
+	//reload of the saved file changes nothing
+	pl.lastSaved = nil
+	rr := pl.reload()
+	if len(rr.Added) != 0 || len(rr.Removed) != 0 || len(rr.Modified) != 0 || len(rr.Errors) != 0 {
+		t.Fatalf("unexpected reload result %v", rr)
+	}
+}
+
+// a reloaded file is not rewritten by autosave, comments and order are kept
+func TestReloadKeepsFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "proxy.yaml")
+	write := func(s string) {
+		err := os.WriteFile(fileName, []byte(s), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`Version: 2
+Proxies:
+  - Id: 1
+    Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10001
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+`)
+
+	pl := newTestProxyList(t)
+	cfg.backups = 0
+	pl.loadCfg(fileName, false)
+	cfg.autoSave = true
+	t.Cleanup(func() { cfg.autoSave = false })
+
+	edited := `# managed by hand
+Version: 2
+Proxies:
+  # ssh of db
+  - Id: 1
+    Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10001
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+    Desc: db
+  - Id: 3
+    Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10003
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+`
+	write(edited)
+	rr := pl.reload()
+	if !slices.Equal(rr.Modified, []int{1}) || !slices.Equal(rr.Added, []int{3}) || len(rr.Errors) != 0 {
+		t.Fatalf("unexpected reload result %v", rr)
+	}
+	time.Sleep(AUTOSAVE_DELAY * 2)
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != edited {
+		t.Fatalf("reloaded file rewritten:\n%s", buf)
+	}
+
+	//new ids are written back
+	write(edited + `  - Type: tcp
+    LocalIp: 127.0.0.1
+    LocalPort: 10004
+    RemoteIp: 127.0.0.1
+    RemotePort: 22
+`)
+	rr = pl.reload()
+	if !slices.Equal(rr.Added, []int{4}) {
+		t.Fatalf("unexpected reload result %v", rr)
+	}
+	buf, err = os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "Id: 4") {
+		t.Fatalf("new id not saved:\n%s", buf)
+	}
+}
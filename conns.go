@@ -0,0 +1,213 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// proxyConn is an active session of a proxy
+type proxyConn struct {
+	Id           int
+	ClientAddr   string
+	UpstreamAddr string
+	StartTime    time.Time
+
+	bytesIn    atomic.Int64 //client to upstream
+	bytesOut   atomic.Int64 //upstream to client
+	lastActive atomic.Int64 //unix nano
+
+	local  net.Conn //nil for udp session, the packet conn is shared
+	remote net.Conn
+	done   chan int //closed when the session finished
+	stats  *proxyStats
+}
+
+// ConnInfo is the snapshot of a session shown by /lcx/proxy/conns
+type ConnInfo struct {
+	Id           int
+	ClientAddr   string
+	UpstreamAddr string
+	StartTime    string
+	LastActive   string
+	BytesIn      int64 //client to upstream
+	BytesOut     int64 //upstream to client
+}
+
+func (pc *proxyConn) info() ConnInfo {
+	return ConnInfo{
+		Id:           pc.Id,
+		ClientAddr:   pc.ClientAddr,
+		UpstreamAddr: pc.UpstreamAddr,
+		StartTime:    pc.StartTime.Format(time.RFC3339),
+		LastActive:   time.Unix(0, pc.lastActive.Load()).Format(time.RFC3339),
+		BytesIn:      pc.bytesIn.Load(),
+		BytesOut:     pc.bytesOut.Load(),
+	}
+}
+
+// count bytes transferred, toRemote is client to upstream direction
+func (pc *proxyConn) count(toRemote bool, n int) {
+	if toRemote {
+		pc.bytesIn.Add(int64(n))
+		pc.stats.bytesIn.Add(int64(n))
+	} else {
+		pc.bytesOut.Add(int64(n))
+		pc.stats.bytesOut.Add(int64(n))
+	}
+	pc.lastActive.Store(time.Now().UnixNano())
+}
+
+func (pc *proxyConn) close() {
+	if pc.local != nil {
+		pc.local.Close()
+	}
+	pc.remote.Close()
+}
+
+// register a session, the instances count follows the registered sessions
+func (pi *ProxyItem) addConn(clientAddr net.Addr, local net.Conn, remote net.Conn) *proxyConn {
+	pi.lock.Lock()
+	if pi.conns == nil {
+		pi.conns = make(map[int]*proxyConn)
+	}
+	pi.connSeq++
+	pc := &proxyConn{
+		Id:           pi.connSeq,
+		ClientAddr:   clientAddr.String(),
+		UpstreamAddr: remote.RemoteAddr().String(),
+		StartTime:    time.Now(),
+		local:        local,
+		remote:       remote,
+		done:         make(chan int),
+		stats:        &pi.stats,
+	}
+	pc.lastActive.Store(pc.StartTime.UnixNano())
+	pi.conns[pc.Id] = pc
+	pi.Instances = len(pi.conns)
+	pi.lock.Unlock()
+
+	info := pc.info()
+	events.publish(EVENT_CONN_OPENED, pi, &info, "")
+	return pc
+}
+
+func (pi *ProxyItem) delConn(pc *proxyConn) {
+	pi.lock.Lock()
+	delete(pi.conns, pc.Id)
+	pi.Instances = len(pi.conns)
+	pi.lock.Unlock()
+
+	pi.stats.observeDuration(time.Since(pc.StartTime))
+	close(pc.done)
+
+	info := pc.info()
+	events.publish(EVENT_CONN_CLOSED, pi, &info, "")
+}
+
+func (pi *ProxyItem) getConns() []*proxyConn {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+
+	var conns = make([]*proxyConn, 0, len(pi.conns))
+	for _, pc := range pi.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+func (pi *ProxyItem) getConn(id int) *proxyConn {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.conns[id]
+}
+
+// get snapshot of active sessions sorted by id
+func (pi *ProxyItem) getConnInfos() []ConnInfo {
+	conns := pi.getConns()
+	var infos = make([]ConnInfo, 0, len(conns))
+	for _, pc := range conns {
+		infos = append(infos, pc.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+// terminate one session
+func (pi *ProxyItem) killConn(id int) bool {
+	pc := pi.getConn(id)
+	if pc == nil {
+		return false
+	}
+
+	log.Println("Killing session", id, "of proxy", pi.Id, "from", pc.ClientAddr)
+	pc.close()
+	<-pc.done
+	return true
+}
+
+// default drain timeout in seconds, for proxies without DrainTimeout
+const DEFAULT_DRAIN_TIMEOUT int = 30
+
+// 0 means default, negative means no wait
+func (pi *ProxyItem) getDrainTimeout() time.Duration {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+
+	if pi.DrainTimeout == 0 {
+		return time.Duration(DEFAULT_DRAIN_TIMEOUT) * time.Second
+	}
+	if pi.DrainTimeout < 0 {
+		return 0
+	}
+	return time.Duration(pi.DrainTimeout) * time.Second
+}
+
+// wait for active sessions to finish until drain timeout, then force close the rest.
+// must be called after the proxy stopped accepting new sessions
+func (pi *ProxyItem) drainConns() {
+	var drained, killed int
+	conns := pi.getConns()
+	timeout := pi.getDrainTimeout()
+
+	if len(conns) > 0 {
+		log.Println("Draining", len(conns), "sessions of proxy", pi.Id, "in", timeout)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	expired := timeout <= 0
+
+	for _, pc := range conns {
+		if !expired {
+			select {
+			case <-pc.done:
+				drained++
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+
+		select {
+		case <-pc.done:
+			drained++
+		default:
+			pc.close()
+			<-pc.done
+			killed++
+		}
+	}
+
+	if len(conns) > 0 {
+		log.Println("Proxy", pi.Id, "drained", drained, "sessions, killed", killed)
+	}
+
+	pi.lock.Lock()
+	pi.drained = drained
+	pi.killed = killed
+	pi.lock.Unlock()
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// timeout of connecting to server. requests have no timeout by default,
+// as stop waits for sessions to drain, DrainTimeout of proxy
+const CTL_DIAL_TIMEOUT = 10 * time.Second
+
+// ctlClient talks to the v2 api of a running go-lcx
+type ctlClient struct {
+	base   string
+	token  string
+	output string //table or json
+	client *http.Client
+}
+
+func newCtlClient(server string, token string, caFile string, insecure bool, output string, timeout time.Duration) (*ctlClient, error) {
+	var d = &net.Dialer{Timeout: CTL_DIAL_TIMEOUT}
+	var tr = &http.Transport{DialContext: d.DialContext, TLSHandshakeTimeout: CTL_DIAL_TIMEOUT}
+	var base = strings.TrimSuffix(server, "/")
+
+	if strings.HasPrefix(server, "unix:") {
+		path := strings.TrimPrefix(server, "unix:")
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://unix"
+	} else if !strings.Contains(server, "://") {
+		base = "http://" + base
+	}
+
+	if caFile != "" || insecure {
+		tc := &tls.Config{InsecureSkipVerify: insecure}
+		if caFile != "" {
+			pool, err := loadCertPool(caFile)
+			if err != nil {
+				return nil, err
+			}
+			tc.RootCAs = pool
+		}
+		tr.TLSClientConfig = tc
+	}
+
+	return &ctlClient{base, token, output, &http.Client{Transport: tr, Timeout: timeout}}, nil
+}
+
+// call api, decode response into out if not nil
+func (c *ctlClient) call(method string, path string, body any, out any) error {
+	var rd io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(j)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var er apiErrorRsp
+		if json.Unmarshal(buf, &er) == nil && er.Error.Message != "" {
+			return fmt.Errorf("%s (%d %s)", er.Error.Message, resp.StatusCode, er.Error.Code)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	if out != nil && len(buf) > 0 {
+		return json.Unmarshal(buf, out)
+	}
+	return nil
+}
+
+func (c *ctlClient) printJson(v any) {
+	j, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(j))
+}
+
+func ctlStatusName(status int) string {
+	var names = []string{"stopped", "running", "starting", "stopping", "failed"}
+	if status >= 0 && status < len(names) {
+		return names[status]
+	}
+	return strconv.Itoa(status)
+}
+
+func (c *ctlClient) printProxies(list []*ProxyItem) {
+	if c.output == "json" {
+		c.printJson(list)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tMODE\tTYPE\tLOCAL\tREMOTE\tAGENT\tCONNS\tGROUP\tTAGS\tDESC")
+	for _, p := range list {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", p.Id, ctlStatusName(p.Status), p.getMode(), p.Type,
+			p.getLocalAddr(), p.getRemoteType()+" "+p.getRemoteAddr(), p.Agent, p.Instances, p.Group, strings.Join(p.Tags, ","), p.Desc)
+	}
+	w.Flush()
+}
+
+func (c *ctlClient) printConns(list []ConnInfo) {
+	if c.output == "json" {
+		c.printJson(list)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLIENT\tUPSTREAM\tSTART\tLAST ACTIVE\tBYTES IN\tBYTES OUT")
+	for _, ci := range list {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\n", ci.Id, ci.ClientAddr, ci.UpstreamAddr,
+			ci.StartTime, ci.LastActive, ci.BytesIn, ci.BytesOut)
+	}
+	w.Flush()
+}
+
+// parse "ip:port" or "unix:/path" into proxy attributes
+func ctlParseAddr(s string) (string, string, int, string, error) {
+	if strings.HasPrefix(s, "unix:") {
+		return "unix", "", 0, strings.TrimPrefix(s, "unix:"), nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", "", 0, "", err
+	}
+	portn, err := strconv.Atoi(port)
+	if err != nil {
+		return "", "", 0, "", fmt.Errorf("invalid port %s", port)
+	}
+	return "", host, portn, "", nil
+}
+
+func (c *ctlClient) add(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	ptype := fs.String("type", "tcp", "Local protocol: tcp, udp or unix")
+	mode := fs.String("mode", MODE_TRAN, "Mode: tran, listen or slave")
+	desc := fs.String("desc", "", "Description")
+	agent := fs.String("agent", "", "Agent which dials remote side")
+	termType := fs.String("term", "ssh", "Terminal type: ssh or telnet")
+	group := fs.String("group", "", "Group name")
+	tags := fs.String("tags", "", "Comma separated tags")
+	start := fs.Bool("start", false, "Start after added")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go-lcx ctl add [options] LOCAL REMOTE")
+		fmt.Fprintln(os.Stderr, "  LOCAL and REMOTE are ip:port or unix:/path")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var pi = &ProxyItem{Mode: *mode, Type: *ptype, Desc: *desc, Agent: *agent, TermType: *termType, Group: *group}
+	if *tags != "" {
+		pi.Tags = strings.Split(*tags, ",")
+	}
+	var err error
+	var ltype string
+
+	ltype, pi.LocalIp, pi.LocalPort, pi.LocalPath, err = ctlParseAddr(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid local address %s: %v", fs.Arg(0), err)
+	}
+	if ltype != "" {
+		pi.Type = ltype
+	}
+
+	pi.RemoteType, pi.RemoteIp, pi.RemotePort, pi.RemotePath, err = ctlParseAddr(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid remote address %s: %v", fs.Arg(1), err)
+	}
+	if pi.RemoteType == "" && pi.Type == "unix" {
+		pi.RemoteType = "tcp"
+	}
+
+	var np = &ProxyItem{}
+	err = c.call(http.MethodPost, "/api/v2/proxies", pi, np)
+	if err != nil {
+		return err
+	}
+
+	if *start {
+		var rsp apiActionRsp
+		err = c.call(http.MethodPost, fmt.Sprintf("/api/v2/proxies/%d/start", np.Id), nil, &rsp)
+		if err != nil {
+			return fmt.Errorf("proxy %d added, but failed to start: %v", np.Id, err)
+		}
+		np = rsp.Proxy
+	}
+
+	c.printProxies([]*ProxyItem{np})
+	return nil
+}
+
+// run action on each proxy id in args
+func (c *ctlClient) eachId(args []string, f func(id string) error) error {
+	if len(args) == 0 {
+		return fmt.Errorf("proxy id missing")
+	}
+
+	var failed error
+	for _, id := range args {
+		err := f(id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Proxy", id+":", err)
+			failed = fmt.Errorf("some operations failed")
+		}
+	}
+	return failed
+}
+
+// parse -group and -tag of list and bulk commands, return query and the rest args
+func ctlParseSelector(name string, args []string) (string, []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	group := fs.String("group", "", "Select proxies in group")
+	tag := fs.String("tag", "", "Select proxies with all these comma separated tags")
+	fs.Parse(args)
+
+	var q = url.Values{}
+	if *group != "" {
+		q.Set("group", *group)
+	}
+	if *tag != "" {
+		q.Set("tag", *tag)
+	}
+	return q.Encode(), fs.Args()
+}
+
+// run action on proxies selected by group or tag
+func (c *ctlClient) bulk(query string, action string) error {
+	var rsp apiBulkRsp
+	err := c.call(http.MethodPost, "/api/v2/bulk/"+action+"?"+query, nil, &rsp)
+	if err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		c.printJson(rsp)
+	} else {
+		for _, r := range rsp.Results {
+			if r.Error != "" {
+				fmt.Fprintln(os.Stderr, "Proxy", r.Id, action, "failed:", r.Error)
+			} else {
+				fmt.Println("Proxy", r.Id, action, "ok")
+			}
+		}
+	}
+
+	if rsp.Failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", rsp.Failed, len(rsp.Results))
+	}
+	return nil
+}
+
+func (c *ctlClient) action(args []string, action string) error {
+	query, args := ctlParseSelector(action, args)
+	if query != "" {
+		return c.bulk(query, action)
+	}
+
+	var results []apiActionRsp
+	err := c.eachId(args, func(id string) error {
+		var rsp apiActionRsp
+		err := c.call(http.MethodPost, "/api/v2/proxies/"+id+"/"+action, nil, &rsp)
+		if err == nil {
+			results = append(results, rsp)
+		}
+		return err
+	})
+
+	if c.output == "json" {
+		c.printJson(results)
+	} else {
+		for _, r := range results {
+			fmt.Printf("Proxy %d %s", r.Proxy.Id, ctlStatusName(r.Proxy.Status))
+			if action == "stop" {
+				fmt.Printf(", drained %d sessions, killed %d", r.Drained, r.Killed)
+			}
+			fmt.Println()
+		}
+	}
+	return err
+}
+
+func (c *ctlClient) conns(args []string) error {
+	fs := flag.NewFlagSet("conns", flag.ExitOnError)
+	kill := fs.Int("kill", 0, "Kill the connection with this id")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go-lcx ctl conns [-kill CONN] ID")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	id := fs.Arg(0)
+	if *kill != 0 {
+		err := c.call(http.MethodDelete, fmt.Sprintf("/api/v2/proxies/%s/connections/%d", id, *kill), nil, nil)
+		if err == nil {
+			fmt.Println("Connection", *kill, "of proxy", id, "killed")
+		}
+		return err
+	}
+
+	var list []ConnInfo
+	err := c.call(http.MethodGet, "/api/v2/proxies/"+id+"/connections", nil, &list)
+	if err != nil {
+		return err
+	}
+	c.printConns(list)
+	return nil
+}
+
+func ctlUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "Usage: go-lcx ctl [options] COMMAND [args]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  list [-group G] [-tag T]       list proxies")
+	fmt.Fprintln(os.Stderr, "  add LOCAL REMOTE               add a proxy, see ctl add -h")
+	fmt.Fprintln(os.Stderr, "  rm ID... | -group G -tag T     delete proxies")
+	fmt.Fprintln(os.Stderr, "  start ID... | -group G -tag T  start proxies")
+	fmt.Fprintln(os.Stderr, "  stop ID... | -group G -tag T   stop proxies")
+	fmt.Fprintln(os.Stderr, "  save                           save proxies to config file of server")
+	fmt.Fprintln(os.Stderr, "  conns [-kill N] ID             list or kill connections of a proxy")
+	fmt.Fprintln(os.Stderr, "Token is created by go-lcx -tokenadd USER, send SIGHUP to the running server to use it")
+	fmt.Fprintln(os.Stderr, "Options:")
+	fs.PrintDefaults()
+}
+
+// go-lcx ctl, return exit code
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	server := fs.String("server", "http://127.0.0.1:8210", "Server url, or unix:/path of admin socket")
+	token := fs.String("token", "", "API token, default to $LCX_TOKEN")
+	output := fs.String("o", "table", "Output format: table or json")
+	caFile := fs.String("cacert", "", "CA file to verify https server")
+	insecure := fs.Bool("insecure", false, "Do not verify https server certificate")
+	timeout := fs.Duration("timeout", 0, "Timeout of each request, 0 waits until done, e.g. stop draining sessions")
+	fs.Usage = func() { ctlUsage(fs) }
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || (*output != "table" && *output != "json") {
+		fs.Usage()
+		return 2
+	}
+
+	if *token == "" {
+		*token = os.Getenv("LCX_TOKEN")
+	}
+
+	c, err := newCtlClient(*server, *token, *caFile, *insecure, *output, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	cmd := fs.Arg(0)
+	cargs := fs.Args()[1:]
+	switch cmd {
+	case "list":
+		var list []*ProxyItem
+		query, _ := ctlParseSelector(cmd, cargs)
+		err = c.call(http.MethodGet, "/api/v2/proxies?"+query, nil, &list)
+		if err == nil {
+			c.printProxies(list)
+		}
+	case "add":
+		err = c.add(cargs)
+	case "rm":
+		query, ids := ctlParseSelector(cmd, cargs)
+		if query != "" {
+			err = c.bulk(query, "delete")
+			break
+		}
+		err = c.eachId(ids, func(id string) error {
+			err := c.call(http.MethodDelete, "/api/v2/proxies/"+id, nil, nil)
+			if err == nil && c.output == "table" {
+				fmt.Println("Proxy", id, "deleted")
+			}
+			return err
+		})
+	case "start", "stop":
+		err = c.action(cargs, cmd)
+	case "save":
+		err = c.call(http.MethodPost, "/api/v2/config/save", nil, nil)
+		if err == nil && c.output == "table" {
+			fmt.Println("Config saved")
+		}
+	case "conns":
+		err = c.conns(cargs)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command:", cmd)
+		fs.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
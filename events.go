@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// event types of proxy state changes
+const (
+	EVENT_ADDED       = "added"
+	EVENT_REMOVED     = "removed"
+	EVENT_MODIFIED    = "modified"
+	EVENT_STARTED     = "started"
+	EVENT_STOPPED     = "stopped"
+	EVENT_FAILED      = "failed"
+	EVENT_CONN_OPENED = "conn_opened"
+	EVENT_CONN_CLOSED = "conn_closed"
+	EVENT_RELOADED    = "reloaded" //config file reloaded, no proxy
+	EVENT_IMPORTED    = "imported" //config imported, no proxy
+	EVENT_HOSTKEY     = "hostkey"  //unknown or changed ssh host key refused
+)
+
+const (
+	EVENT_HISTORY    = 256 //recent events kept for resuming subscribers
+	EVENT_QUEUE      = 64  //events queued for a subscriber before it is dropped
+	EVENT_KEEP_ALIVE = 30 * time.Second
+)
+
+type Event struct {
+	Seq     int64
+	Type    string
+	Time    string
+	ProxyId int
+	Proxy   json.RawMessage `json:",omitempty"` //proxy after the change
+	Conn    *ConnInfo       `json:",omitempty"` //for connection events
+	Error   string          `json:",omitempty"` //for failed
+	Reload  *ReloadResult   `json:",omitempty"` //for reloaded and imported
+	HostKey *HostKeyChange  `json:",omitempty"` //for hostkey
+}
+
+type eventBus struct {
+	lock   sync.Mutex
+	seq    int64
+	recent []Event
+	subs   map[chan Event]bool
+}
+
+var events = &eventBus{subs: make(map[chan Event]bool)}
+
+// publish an event of proxy, must not be called with pi.lock held
+func (eb *eventBus) publish(typ string, pi *ProxyItem, conn *ConnInfo, errStr string) {
+	eb.send(Event{
+		Type:    typ,
+		ProxyId: pi.Id,
+		Proxy:   pi.ToJson(),
+		Conn:    conn,
+		Error:   errStr,
+	})
+}
+
+func (eb *eventBus) publishReload(rr *ReloadResult) {
+	eb.send(Event{Type: EVENT_RELOADED, Reload: rr})
+}
+
+func (eb *eventBus) publishImport(rr *ReloadResult) {
+	eb.send(Event{Type: EVENT_IMPORTED, Reload: rr})
+}
+
+func (eb *eventBus) publishHostKey(pi *ProxyItem, hc *HostKeyChange) {
+	eb.send(Event{Type: EVENT_HOSTKEY, ProxyId: pi.Id, HostKey: hc})
+}
+
+func (eb *eventBus) send(e Event) {
+	e.Time = time.Now().Format(time.RFC3339)
+
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	eb.seq++
+	e.Seq = eb.seq
+	eb.recent = append(eb.recent, e)
+	if len(eb.recent) > EVENT_HISTORY {
+		eb.recent = eb.recent[len(eb.recent)-EVENT_HISTORY:]
+	}
+
+	for ch := range eb.subs {
+		select {
+		case ch <- e:
+		default:
+			//too slow, drop it, it can resume with Last-Event-ID
+			delete(eb.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe events, return the recent events after lastSeq
+func (eb *eventBus) subscribe(lastSeq int64) (chan Event, []Event) {
+	ch := make(chan Event, EVENT_QUEUE)
+
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	var replay []Event
+	if lastSeq > 0 {
+		for _, e := range eb.recent {
+			if e.Seq > lastSeq {
+				replay = append(replay, e)
+			}
+		}
+	}
+	eb.subs[ch] = true
+	return ch, replay
+}
+
+func (eb *eventBus) unsubscribe(ch chan Event) {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	if eb.subs[ch] {
+		delete(eb.subs, ch)
+		close(ch)
+	}
+}
+
+func writeEvent(resp http.ResponseWriter, e *Event) error {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, j)
+	return err
+}
+
+// server-sent events of proxy changes
+// optional params: proxy=id, types=started,stopped, lastid=seq or header Last-Event-ID
+func eventsHandler(resp http.ResponseWriter, req *http.Request) {
+	var proxyId int
+	var types []string
+
+	if req.FormValue("proxy") != "" {
+		id, err := strconv.Atoi(req.FormValue("proxy"))
+		if err != nil {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, "Invalid proxy id: "+req.FormValue("proxy"))
+			return
+		}
+		proxyId = id
+	}
+	types = splitList(req.FormValue("types"))
+
+	lastId := req.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = req.FormValue("lastid")
+	}
+	lastSeq, _ := strconv.ParseInt(lastId, 10, 64)
+
+	match := func(e *Event) bool {
+		if proxyId != 0 && e.ProxyId != proxyId {
+			return false
+		}
+		return len(types) == 0 || slices.Contains(types, e.Type)
+	}
+
+	rc := http.NewResponseController(resp)
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+
+	ch, replay := events.subscribe(lastSeq)
+	defer events.unsubscribe(ch)
+
+	for i := range replay {
+		if match(&replay[i]) && writeEvent(resp, &replay[i]) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(EVENT_KEEP_ALIVE)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !match(&e) {
+				continue
+			}
+			if writeEvent(resp, &e) != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(resp, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
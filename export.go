@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var formatContentTypes = map[string]string{
+	FORMAT_JSON: "application/json",
+	FORMAT_YAML: "application/yaml",
+	FORMAT_TOML: "application/toml",
+}
+
+// format from query, or content type of request
+func getReqFormat(req *http.Request) string {
+	format := req.URL.Query().Get("format")
+	if format != "" {
+		return format
+	}
+
+	ct := req.Header.Get("Content-Type")
+	for f, t := range formatContentTypes {
+		if strings.HasPrefix(ct, t) {
+			return f
+		}
+	}
+	return FORMAT_JSON
+}
+
+// /lcx/export?format=json|yaml|toml
+func exportHandler(resp http.ResponseWriter, req *http.Request) {
+	format := getReqFormat(req)
+	err := checkFormat(format)
+	if err != nil {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, err.Error())
+		return
+	}
+
+	buf, err := proxies.encodeConfig(format)
+	if err != nil {
+		writeApiError(resp, http.StatusInternalServerError, API_ERR_INTERNAL_ERROR, err.Error())
+		return
+	}
+
+	resp.Header().Set("Content-Type", formatContentTypes[format])
+	resp.Header().Set("Content-Disposition", "attachment; filename=\"proxy_config."+format+"\"")
+	resp.Write(buf)
+}
+
+// /lcx/import?mode=merge|replace&dryrun=true&format=json|yaml|toml, body is a config of any version
+func importHandler(resp http.ResponseWriter, req *http.Request) {
+	format := getReqFormat(req)
+	err := checkFormat(format)
+	if err != nil {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, err.Error())
+		return
+	}
+
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = APPLY_MERGE
+	}
+	if mode != APPLY_MERGE && mode != APPLY_REPLACE {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, "Unknown import mode: "+mode)
+		return
+	}
+	dryRun := req.URL.Query().Get("dryrun") == "true" || req.URL.Query().Get("dryrun") == "1"
+
+	defer req.Body.Close()
+	buf, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, API_MAX_BODY))
+	if err != nil {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_BAD_REQUEST, err.Error())
+		return
+	}
+
+	items, _, err := parseConfigAs(buf, format)
+	if err != nil {
+		writeApiError(resp, http.StatusBadRequest, API_ERR_BAD_REQUEST, "Invalid config: "+err.Error())
+		return
+	}
+
+	rr := proxies.apply(items, mode, dryRun)
+	if !dryRun {
+		log.Println("User", getReqUserName(req), "imported config,", mode+":", rr)
+		events.publishImport(rr)
+	}
+	writeApiJson(resp, http.StatusOK, rr)
+}
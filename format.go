@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// config file formats, all are converted to and from json
+const (
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+// config format by file extension
+func getCfgFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	case ".toml":
+		return FORMAT_TOML
+	}
+	return FORMAT_JSON
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case FORMAT_JSON, FORMAT_YAML, FORMAT_TOML:
+		return nil
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
+
+// clear flow and quoting styles from json, keep the key order
+func clearYamlStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		clearYamlStyle(c)
+	}
+}
+
+// convert json numbers to int64 and drop nulls, toml has no null
+func normalizeForToml(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, e := range t {
+			if e == nil {
+				delete(t, k)
+			} else {
+				t[k] = normalizeForToml(e)
+			}
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = normalizeForToml(e)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// convert json to format
+func fromJson(buf []byte, format string) ([]byte, error) {
+	switch format {
+	case FORMAT_YAML:
+		var node yaml.Node
+		err := yaml.Unmarshal(buf, &node)
+		if err != nil {
+			return nil, err
+		}
+		clearYamlStyle(&node)
+
+		var out bytes.Buffer
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		err = enc.Encode(&node)
+		if err != nil {
+			return nil, err
+		}
+		enc.Close()
+		return out.Bytes(), nil
+
+	case FORMAT_TOML:
+		var v any
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		err := dec.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+
+		var out bytes.Buffer
+		err = toml.NewEncoder(&out).Encode(normalizeForToml(v))
+		return out.Bytes(), err
+	}
+
+	return buf, nil
+}
+
+// convert format to json
+func toJson(buf []byte, format string) ([]byte, error) {
+	var v any
+
+	switch format {
+	case FORMAT_YAML:
+		err := yaml.Unmarshal(buf, &v)
+		if err != nil {
+			return nil, err
+		}
+	case FORMAT_TOML:
+		_, err := toml.Decode(string(buf), &v)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return buf, nil
+	}
+
+	return json.Marshal(v)
+}
@@ -3,9 +3,11 @@ module github.com/ezware/go-lcx
 go 1.22.3
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/gobwas/ws v1.4.0
 	github.com/ziutek/telnet v0.0.0-20180329124119-c3b780dc415b
 	golang.org/x/crypto v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
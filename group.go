@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// group and tags are used in query params, so no separators allowed
+func checkTags(group string, tags []string) error {
+	if strings.ContainsAny(group, ", \t\r\n") {
+		return fmt.Errorf("invalid group %q", group)
+	}
+
+	for i, t := range tags {
+		if t == "" || strings.ContainsAny(t, ", \t\r\n") {
+			return fmt.Errorf("invalid tag %q", t)
+		}
+		if slices.Contains(tags[:i], t) {
+			return fmt.Errorf("duplicated tag %s", t)
+		}
+	}
+	return nil
+}
+
+// proxyFilter selects proxies by group, tags and ids, empty fields match all
+type proxyFilter struct {
+	group    string
+	hasGroup bool     //group given, empty group selects proxies without group
+	tags     []string //proxy must have all these tags
+	ids      []int
+}
+
+// parse ?group=G&tag=T1,T2&tag=T3&id=1,2
+func parseProxyFilter(query url.Values) (*proxyFilter, error) {
+	var f = &proxyFilter{group: query.Get("group"), hasGroup: query.Has("group")}
+
+	for _, v := range query["tag"] {
+		for _, t := range strings.Split(v, ",") {
+			if t != "" {
+				f.tags = append(f.tags, t)
+			}
+		}
+	}
+
+	for _, v := range query["id"] {
+		for _, s := range strings.Split(v, ",") {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy id %s", s)
+			}
+			f.ids = append(f.ids, id)
+		}
+	}
+	return f, nil
+}
+
+func (f *proxyFilter) empty() bool {
+	return !f.hasGroup && len(f.tags) == 0 && len(f.ids) == 0
+}
+
+func (f *proxyFilter) match(pi *ProxyItem) bool {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+
+	if f.hasGroup && pi.Group != f.group {
+		return false
+	}
+	for _, t := range f.tags {
+		if !slices.Contains(pi.Tags, t) {
+			return false
+		}
+	}
+	if len(f.ids) > 0 && !slices.Contains(f.ids, pi.Id) {
+		return false
+	}
+	return true
+}
+
+func (pl *ProxyList) filter(f *proxyFilter) []*ProxyItem {
+	var items []*ProxyItem
+	for _, pi := range pl.list() {
+		if f.match(pi) {
+			items = append(items, pi)
+		}
+	}
+	return items
+}
+
+// result of bulk operation on one proxy
+type apiBulkResult struct {
+	Id    int
+	Error string `json:",omitempty"`
+}
+
+type apiBulkRsp struct {
+	Results []apiBulkResult
+	Failed  int
+}
+
+// /api/v2/bulk/start, stop, restart, delete and modify?group=G&tag=T&id=N
+// modify merges the json body into config of each selected proxy
+func apiBulkHandler(action string) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		f, err := parseProxyFilter(req.URL.Query())
+		if err != nil {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, err.Error())
+			return
+		}
+		if f.empty() {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, "No proxy selected, need group, tag or id")
+			return
+		}
+
+		var patch []byte
+		if action == "modify" {
+			defer req.Body.Close()
+			patch, err = io.ReadAll(http.MaxBytesReader(resp, req.Body, API_MAX_BODY))
+			if err == nil {
+				var m map[string]json.RawMessage
+				err = json.Unmarshal(patch, &m)
+			}
+			if err != nil {
+				writeApiError(resp, http.StatusBadRequest, API_ERR_BAD_REQUEST, "Invalid request body: "+err.Error())
+				return
+			}
+		}
+
+		items := proxies.filter(f)
+		log.Println("User", getReqUserName(req), "bulk", action, len(items), "proxies")
+
+		//proxies are independent, stop may wait for draining, so run them together
+		var rsp = apiBulkRsp{Results: make([]apiBulkResult, len(items))}
+		var wg sync.WaitGroup
+		for i, pi := range items {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rsp.Results[i].Id = pi.Id
+				err := bulkAction(pi, action, patch)
+				if err != nil {
+					rsp.Results[i].Error = strings.TrimSpace(err.Error())
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, r := range rsp.Results {
+			if r.Error != "" {
+				rsp.Failed++
+			}
+		}
+		writeApiJson(resp, http.StatusOK, rsp)
+	}
+}
+
+func bulkAction(pi *ProxyItem, action string, patch []byte) error {
+	switch action {
+	case "start":
+		return pi.start()
+	case "stop":
+		pi.stop()
+	case "restart":
+		return pi.restart()
+	case "delete":
+		return proxies.del(strconv.Itoa(pi.Id))
+	case "modify":
+		newp := pi.config()
+		err := json.Unmarshal(patch, newp)
+		if err != nil {
+			return err
+		}
+		newp.Id = pi.Id
+		newp.addDefaults()
+		err = newp.checkParam(true)
+		if err != nil {
+			return err
+		}
+		return proxies.modify(newp)
+	}
+	return nil
+}
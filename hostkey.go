@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKey is a trusted or revoked key in known hosts file
+type HostKey struct {
+	Host        string //host patterns of the line, hashed hosts are not readable
+	Marker      string //@revoked or @cert-authority, empty for host key
+	KeyType     string
+	Fingerprint string
+}
+
+// HostKeyChange is an unknown or changed host key waiting for admin to accept or reject
+type HostKeyChange struct {
+	Id             int
+	Host           string
+	ProxyId        int
+	User           string //web user who connected
+	KeyType        string
+	OldFingerprint string //empty for unknown host in strict mode
+	Fingerprint    string
+	Time           string
+	key            ssh.PublicKey
+}
+
+// one line of known hosts file, lines not understood are kept as is
+type hostKeyEntry struct {
+	line    string //original text, empty if the line is new or changed
+	marker  string
+	hosts   []string
+	key     ssh.PublicKey //nil for comments and lines failed to parse
+	comment string
+}
+
+func (e *hostKeyEntry) String() string {
+	if e.line != "" || e.key == nil {
+		return e.line
+	}
+
+	var s = knownhosts.Line(e.hosts, e.key)
+	if e.marker != "" {
+		s = e.marker + " " + s
+	}
+	if e.comment != "" {
+		s += " " + e.comment
+	}
+	return s
+}
+
+// match host with patterns of the line, a negated pattern which matches excludes the host.
+// exact is true if a plain or hashed pattern is the host itself
+func (e *hostKeyEntry) match(host string) (matched bool, exact bool) {
+	for _, pat := range e.hosts {
+		negated := strings.HasPrefix(pat, "!")
+		pat = strings.TrimPrefix(pat, "!")
+
+		var ok bool
+		if strings.HasPrefix(pat, "|1|") {
+			ok = hashedHostMatch(pat, host)
+		} else {
+			ok = wildcardMatch(pat, host)
+		}
+		if !ok {
+			continue
+		}
+		if negated {
+			return false, false
+		}
+		matched = true
+		if !strings.ContainsAny(pat, "*?") {
+			exact = true
+		}
+	}
+	return matched, exact
+}
+
+// match host with a known hosts wildcard pattern, * for any chars and ? for one char
+func wildcardMatch(pat string, s string) bool {
+	for len(pat) > 0 {
+		switch pat[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pat[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pat[0] != s[0] {
+				return false
+			}
+		}
+		pat = pat[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// match host with |1|salt|hash written by ssh-keygen -H
+func hashedHostMatch(pat string, host string) bool {
+	parts := strings.Split(pat, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+type HostKeyMgr struct {
+	lock     sync.Mutex
+	fileName string
+	keys     []*hostKeyEntry
+	hashed   bool //file has hashed hosts, new hosts are hashed too
+	pending  []*HostKeyChange
+	seq      int
+}
+
+var hostKeys = &HostKeyMgr{}
+
+func (hm *HostKeyMgr) load(fileName string) error {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	hm.fileName = fileName
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		var e = &hostKeyEntry{line: line}
+		hm.keys = append(hm.keys, e)
+
+		s := strings.TrimSpace(line)
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		e.marker, e.hosts, e.key, e.comment, _, err = ssh.ParseKnownHosts([]byte(s))
+		if err != nil {
+			log.Println("Kept line", i+1, "of known hosts file", fileName, "failed to parse:", err)
+			e.key = nil
+			continue
+		}
+		if e.marker != "" {
+			e.marker = "@" + e.marker
+		}
+		for _, h := range e.hosts {
+			if strings.HasPrefix(h, "|1|") {
+				hm.hashed = true
+			}
+		}
+	}
+	return nil
+}
+
+func (hm *HostKeyMgr) save() error {
+	var buf bytes.Buffer
+	for _, e := range hm.keys {
+		buf.WriteString(e.String() + "\n")
+	}
+	return writeFileAtomic(hm.fileName, buf.Bytes(), 0, 0600)
+}
+
+func (hm *HostKeyMgr) revoked(key ssh.PublicKey) bool {
+	for _, e := range hm.keys {
+		if e.marker == "@revoked" && e.key != nil && bytes.Equal(e.key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// find keys of host, and whether key is one of them
+func (hm *HostKeyMgr) lookup(host string, key ssh.PublicKey) ([]ssh.PublicKey, bool) {
+	var known []ssh.PublicKey
+	for _, e := range hm.keys {
+		if e.key == nil || e.marker != "" {
+			continue
+		}
+		if ok, _ := e.match(host); !ok {
+			continue
+		}
+		if bytes.Equal(e.key.Marshal(), key.Marshal()) {
+			return nil, true
+		}
+		known = append(known, e.key)
+	}
+	return known, false
+}
+
+// plain host key algorithms, tried after those of known keys
+var hostKeyAlgos = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// host key algorithms with those of known keys of host first, so the server sends a key we can check.
+// nil to use defaults if host is unknown or trusted by a cert authority
+func (hm *HostKeyMgr) algorithms(host string) []string {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	var algos []string
+	for _, e := range hm.keys {
+		if e.key == nil || e.marker == "@revoked" {
+			continue
+		}
+		if ok, _ := e.match(host); !ok {
+			continue
+		}
+		if e.marker != "" {
+			return nil
+		}
+
+		var list = []string{e.key.Type()}
+		if e.key.Type() == ssh.KeyAlgoRSA {
+			list = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, a := range list {
+			if !slices.Contains(algos, a) {
+				algos = append(algos, a)
+			}
+		}
+	}
+
+	//other types still get the changed key warning
+	if len(algos) > 0 {
+		for _, a := range hostKeyAlgos {
+			if !slices.Contains(algos, a) {
+				algos = append(algos, a)
+			}
+		}
+	}
+	return algos
+}
+
+// add trusted key of host, hashed if the file uses hashed hosts
+func (hm *HostKeyMgr) addKey(host string, key ssh.PublicKey) {
+	pat := host
+	if hm.hashed {
+		pat = knownhosts.HashHostname(host)
+	}
+	hm.keys = append(hm.keys, &hostKeyEntry{hosts: []string{pat}, key: key})
+}
+
+// remove host from lines of its keys, lines matching it by wildcard are kept for other hosts
+func (hm *HostKeyMgr) delHost(host string) []*hostKeyEntry {
+	var keys []*hostKeyEntry
+	for _, e := range hm.keys {
+		if e.key == nil || e.marker != "" {
+			keys = append(keys, e)
+			continue
+		}
+		if _, exact := e.match(host); !exact {
+			keys = append(keys, e)
+			continue
+		}
+
+		var hosts []string
+		for _, pat := range e.hosts {
+			probe := &hostKeyEntry{hosts: []string{pat}}
+			if _, exact := probe.match(host); !exact {
+				hosts = append(hosts, pat)
+			}
+		}
+		if len(hosts) > 0 {
+			keys = append(keys, &hostKeyEntry{marker: e.marker, hosts: hosts, key: e.key, comment: e.comment})
+		}
+	}
+	return keys
+}
+
+// add change waiting for admin, same key of same host is recorded once
+func (hm *HostKeyMgr) addPending(hc *HostKeyChange) *HostKeyChange {
+	for _, p := range hm.pending {
+		if p.Host == hc.Host && p.Fingerprint == hc.Fingerprint {
+			p.ProxyId, p.User, p.Time = hc.ProxyId, hc.User, hc.Time
+			return p
+		}
+	}
+
+	hm.seq++
+	hc.Id = hm.seq
+	hm.pending = append(hm.pending, hc)
+	return hc
+}
+
+func (hm *HostKeyMgr) list() []HostKey {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	var list = []HostKey{}
+	for _, e := range hm.keys {
+		if e.key != nil {
+			list = append(list, HostKey{strings.Join(e.hosts, ","), e.marker, e.key.Type(), ssh.FingerprintSHA256(e.key)})
+		}
+	}
+	return list
+}
+
+func (hm *HostKeyMgr) listPending() []HostKeyChange {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	var list = []HostKeyChange{}
+	for _, p := range hm.pending {
+		list = append(list, *p)
+	}
+	return list
+}
+
+// accept replaces all keys of the host by the new one, reject just drops it
+func (hm *HostKeyMgr) resolve(id int, accept bool) (*HostKeyChange, error) {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	idx := slices.IndexFunc(hm.pending, func(p *HostKeyChange) bool { return p.Id == id })
+	if idx < 0 {
+		return nil, fmt.Errorf("host key change %d not exist", id)
+	}
+	hc := hm.pending[idx]
+
+	if accept {
+		old := hm.keys
+		hm.keys = hm.delHost(hc.Host)
+		hm.addKey(hc.Host, hc.key)
+		err := hm.save()
+		if err != nil {
+			hm.keys = old
+			return hc, err
+		}
+	}
+
+	//other changes of the host are outdated
+	hm.pending = slices.DeleteFunc(hm.pending, func(p *HostKeyChange) bool {
+		return p.Id == id || (accept && p.Host == hc.Host)
+	})
+	return hc, nil
+}
+
+func hostKeyWarning(hc *HostKeyChange) string {
+	var lines []string
+	if hc.OldFingerprint == "" {
+		lines = []string{
+			"Host key of " + hc.Host + " is unknown, strict host key checking is on.",
+			hc.KeyType + " key fingerprint is " + hc.Fingerprint + ".",
+		}
+	} else {
+		lines = []string{
+			"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@",
+			"@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @",
+			"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@",
+			"IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!",
+			"Someone could be eavesdropping on you right now (man-in-the-middle attack)!",
+			"It is also possible that the host key of " + hc.Host + " has just been changed.",
+			"Known key fingerprint is " + hc.OldFingerprint + ".",
+			"Received " + hc.KeyType + " key fingerprint is " + hc.Fingerprint + ".",
+		}
+	}
+	lines = append(lines, "Connection refused, an admin can accept the key in web UI.")
+	return "\r\n" + strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// name of remote target of proxy in known hosts, agent/host if it is reached through an agent,
+// since the same address behind different agents may be different hosts
+func hostKeyName(p *ProxyItem) string {
+	host := knownhosts.Normalize(p.getTermRemote())
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.Agent != "" {
+		return p.Agent + "/" + host
+	}
+	return host
+}
+
+// check host key against known hosts, trust on first use unless -stricthostkey.
+// host is the remote target of proxy, warnings are written to terminal conn
+func (hm *HostKeyMgr) callback(conn net.Conn, p *ProxyItem, owner string) ssh.HostKeyCallback {
+	host := hostKeyName(p)
+
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		hm.lock.Lock()
+		if hm.revoked(key) {
+			hm.lock.Unlock()
+			fp := ssh.FingerprintSHA256(key)
+			log.Println("Refused revoked host key of", host, key.Type(), fp)
+			wsutil.WriteServerText(conn, []byte("\r\nHost key "+key.Type()+" "+fp+" of "+host+" is revoked in known hosts, connection refused.\r\n"))
+			return fmt.Errorf("host key of %s is revoked", host)
+		}
+
+		known, ok := hm.lookup(host, key)
+		if ok {
+			hm.lock.Unlock()
+			return nil
+		}
+
+		fp := ssh.FingerprintSHA256(key)
+		if len(known) == 0 && !cfg.strictHostKey {
+			hm.addKey(host, key)
+			err := hm.save()
+			hm.lock.Unlock()
+			if err != nil {
+				log.Println("Failed to save known hosts file", hm.fileName, err)
+			}
+
+			log.Println("Added host key of", host, key.Type(), fp, "to known hosts")
+			wsutil.WriteServerText(conn, []byte("Permanently added "+key.Type()+" key "+fp+" of "+host+" to known hosts.\r\n"))
+			return nil
+		}
+
+		var hc = &HostKeyChange{
+			Host:        host,
+			ProxyId:     p.Id,
+			User:        owner,
+			KeyType:     key.Type(),
+			Fingerprint: fp,
+			Time:        time.Now().Format(time.RFC3339),
+			key:         key,
+		}
+		if len(known) > 0 {
+			hc.OldFingerprint = ssh.FingerprintSHA256(known[0])
+		}
+		hc = hm.addPending(hc)
+		copied := *hc
+		hm.lock.Unlock()
+
+		log.Printf("Refused host key of %s %s %s, known key %q, pending change %d", host, copied.KeyType, copied.Fingerprint, copied.OldFingerprint, copied.Id)
+		events.publishHostKey(p, &copied)
+		wsutil.WriteServerText(conn, []byte(hostKeyWarning(&copied)))
+		if hc.OldFingerprint == "" {
+			return fmt.Errorf("host key of %s is unknown", host)
+		}
+		return fmt.Errorf("host key of %s has changed", host)
+	}
+}
+
+func initHostKeys() {
+	err := hostKeys.load(cfg.knownHosts)
+	if err != nil {
+		log.Println("Failed to load known hosts file", cfg.knownHosts, err)
+	}
+}
+
+// /api/v2/hostkeys
+func apiHostKeysHandler(resp http.ResponseWriter, req *http.Request) {
+	writeApiJson(resp, http.StatusOK, hostKeys.list())
+}
+
+// /api/v2/hostkeys/pending
+func apiHostKeyPendingHandler(resp http.ResponseWriter, req *http.Request) {
+	writeApiJson(resp, http.StatusOK, hostKeys.listPending())
+}
+
+// /api/v2/hostkeys/pending/{id}/accept and reject
+func apiHostKeyResolveHandler(accept bool) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		id, _ := strconv.Atoi(req.PathValue("id"))
+		hc, err := hostKeys.resolve(id, accept)
+		if hc == nil {
+			writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, err.Error())
+			return
+		}
+		if err != nil {
+			writeApiError(resp, http.StatusInternalServerError, API_ERR_INTERNAL_ERROR, err.Error())
+			return
+		}
+
+		action := "rejected"
+		if accept {
+			action = "accepted"
+		}
+		log.Println("User", getReqUserName(req), action, "host key of", hc.Host, hc.KeyType, hc.Fingerprint)
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyFile(t *testing.T) {
+	hashedKey, revokedKey, caKey, wildKey, newKey := testHostKey(t), testHostKey(t), testHostKey(t), testHostKey(t), testHostKey(t)
+	lines := []string{
+		"# comment",
+		knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.1")}, hashedKey),
+		"@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(revokedKey))),
+		"@cert-authority *.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey))),
+		"not a valid line",
+		knownhosts.Line([]string{"10.0.1.*", "!10.0.1.9"}, wildKey),
+		"",
+	}
+	fileName := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(fileName, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hm := &HostKeyMgr{}
+	err = hm.load(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := hm.lookup("10.0.0.1", hashedKey); !ok {
+		t.Fatal("hashed host not matched")
+	}
+	if _, ok := hm.lookup("10.0.1.5", wildKey); !ok {
+		t.Fatal("wildcard host not matched")
+	}
+	if known, ok := hm.lookup("10.0.1.9", wildKey); ok || len(known) != 0 {
+		t.Fatal("negated host matched")
+	}
+	if !hm.revoked(revokedKey) || hm.revoked(hashedKey) {
+		t.Fatal("revoked key not honoured")
+	}
+	if algos := hm.algorithms("10.0.0.1"); len(algos) == 0 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("unexpected algorithms %v", algos)
+	}
+	if algos := hm.algorithms("a.example.com"); algos != nil {
+		t.Fatalf("unexpected algorithms %v of host trusted by cert authority", algos)
+	}
+
+	//accepting a new key of the hashed host keeps all other lines, and the new host is hashed
+	hm.pending = []*HostKeyChange{{Id: 1, Host: "10.0.0.1", key: newKey}}
+	_, err = hm.resolve(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := strings.Split(string(buf), "\n")
+	for _, l := range []string{lines[0], lines[2], lines[3], lines[4], lines[5]} {
+		if !strings.Contains(string(buf), l) {
+			t.Fatalf("line %q lost:\n%s", l, buf)
+		}
+	}
+	if strings.Contains(string(buf), lines[1]) || strings.Contains(string(buf), "10.0.0.1") {
+		t.Fatalf("old key kept or host saved in plaintext:\n%s", buf)
+	}
+	if len(saved) != len(lines)+1 {
+		t.Fatalf("unexpected lines:\n%s", buf)
+	}
+
+	hm = &HostKeyMgr{}
+	hm.load(fileName)
+	if _, ok := hm.lookup("10.0.0.1", newKey); !ok {
+		t.Fatal("accepted key not saved")
+	}
+}
+
+func TestHostKeyName(t *testing.T) {
+	p := &ProxyItem{Type: "tcp", RemoteIp: "10.0.0.1", RemotePort: 22}
+	if name := hostKeyName(p); name != "10.0.0.1" {
+		t.Fatalf("unexpected name %s", name)
+	}
+	p.RemotePort, p.Agent = 2222, "dc1"
+	if name := hostKeyName(p); name != "dc1/[10.0.0.1]:2222" {
+		t.Fatalf("unexpected name %s", name)
+	}
+}
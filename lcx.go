@@ -6,14 +6,24 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
+// proxy lifecycle states
+//
+//	stopped -> starting -> running -> stopping -> stopped
+//	              |
+//	              +-> failed -> starting ...
 const (
 	STATUS_STOPPED int = iota
-	STATUS_STARTED
+	STATUS_RUNNING
+	STATUS_STARTING
+	STATUS_STOPPING
+	STATUS_FAILED
 	//STATUS_CONNECTED, use instances to indicate the connect status
 )
 
@@ -25,24 +35,121 @@ type ProxyItem struct {
 	RemoteIp   string
 	RemotePort int
 	Desc       string
-	Type       string //tcp, udp, unix
-	TermType   string //ssh, telnet
+	Group      string   //group name, e.g. lab rack
+	Tags       []string //labels for filter and bulk operations
+	Mode       string   //tran, listen, slave
+	Type       string   //tcp, udp, unix
+	RemoteType string   //tcp, unix, same as Type if empty
+	LocalPath  string   //unix socket path of local side
+	RemotePath string   //unix socket path of remote side
+	SockMode   string   //local unix socket file permission, e.g. 0660
+	Agent      string   //name of the agent which dials remote side, empty for local
+	TermType   string   //ssh, telnet
+	UdpTimeout int      //udp session idle timeout in seconds
+	Allow      []string //allowed source cidrs, empty allows all
+	Deny       []string //denied source cidrs, checked before Allow
+
+	//seconds to wait for active sessions on stop, then close them.
+	//0 waits DEFAULT_DRAIN_TIMEOUT, negative closes them at once
+	DrainTimeout int
+
+	//forward ssh-agent of -sshagent to ssh sessions of web terminal
+	SshAgentForward bool
+	//offer identities of -sshagent to ssh login of web terminal
+	SshAgentAuth bool
 
 	//runtime attributes
 	Instances int
+	LastError string //error of last start
 	stopCh    chan int
+	done      chan int //closed when proxy server exited
 	mgr       *ProxyList
+	conns     map[int]*proxyConn //active sessions
+	connSeq   int
+	drained   int //sessions finished during last stop
+	killed    int //sessions closed by last stop
+	stats     proxyStats
+	acl       *proxyAcl //parsed Allow and Deny, built on start
+
+	lock   sync.Mutex //protects the fields above
+	opLock sync.Mutex //serializes start, stop and modify
+}
+
+type proxyItemJson ProxyItem
+
+func (pi *ProxyItem) MarshalJSON() ([]byte, error) {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return json.Marshal((*proxyItemJson)(pi))
+}
+
+func (pi *ProxyItem) String() string {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return fmt.Sprintf("proxy %d (%s %s %s -> %s, status %d, instances %d)", pi.Id, pi.getMode(),
+		pi.Type, pi.getLocalAddr(), pi.getRemoteAddr(), pi.Status, pi.Instances)
+}
+
+func (pi *ProxyItem) getStatus() int {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.Status
+}
+
+func (pi *ProxyItem) setStatus(status int) {
+	pi.lock.Lock()
+	pi.Status = status
+	pi.lock.Unlock()
+}
+
+// get type, address and term type used by web terminal
+func (pi *ProxyItem) getTermTarget() (string, string, string) {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.Type, pi.getLocalAddr(), pi.TermType
+}
+
+// remote target behind local address of web terminal
+func (pi *ProxyItem) getTermRemote() string {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.getRemoteAddr()
+}
+
+func (pi *ProxyItem) getSshAgentForward() bool {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.SshAgentForward
+}
+
+func (pi *ProxyItem) getSshAgentAuth() bool {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+	return pi.SshAgentAuth
+}
+
+func (pi *ProxyItem) getRemoteType() string {
+	if pi.RemoteType == "" {
+		return pi.Type
+	}
+	return pi.RemoteType
 }
 
 func (pi *ProxyItem) getLocalAddr() string {
-	return pi.LocalIp + ":" + strconv.Itoa(pi.LocalPort)
+	if pi.Type == "unix" {
+		return pi.LocalPath
+	}
+	return net.JoinHostPort(pi.LocalIp, strconv.Itoa(pi.LocalPort))
 }
 
 func (pi *ProxyItem) getRemoteAddr() string {
-	return pi.RemoteIp + ":" + strconv.Itoa(pi.RemotePort)
+	if pi.getRemoteType() == "unix" {
+		return pi.RemotePath
+	}
+	return net.JoinHostPort(pi.RemoteIp, strconv.Itoa(pi.RemotePort))
 }
 
-func transData(readConn net.Conn, writeConn net.Conn, stopch chan error, tips string) {
+func transData(readConn net.Conn, writeConn net.Conn, stopch chan error, tips string, count func(int)) {
 	var buf = make([]byte, 4096)
 	var debug = false
 
@@ -62,6 +169,7 @@ func transData(readConn net.Conn, writeConn net.Conn, stopch chan error, tips st
 				stopch <- err
 				return
 			} else {
+				count(nbytesWrite)
 				if debug {
 					fmt.Println(tips, "Writed", nbytesWrite, "bytes data")
 				}
@@ -70,16 +178,19 @@ func transData(readConn net.Conn, writeConn net.Conn, stopch chan error, tips st
 	}
 }
 
-func serverConn(pi *ProxyItem, local net.Conn, remote net.Conn) {
+func serverConn(pi *ProxyItem, pc *proxyConn) {
+	local := pc.local
+	remote := pc.remote
+	defer pi.delConn(pc)
 	defer local.Close()
 	defer remote.Close()
 	var err error
-	l2rCh := make(chan error)
-	r2lCh := make(chan error)
+	l2rCh := make(chan error, 1)
+	r2lCh := make(chan error, 1)
 
-	go transData(local, remote, l2rCh, "local2remote")
+	go transData(local, remote, l2rCh, "local2remote", func(n int) { pc.count(true, n) })
 	time.After(time.Microsecond)
-	go transData(remote, local, r2lCh, "remote2local")
+	go transData(remote, local, r2lCh, "remote2local", func(n int) { pc.count(false, n) })
 
 	select {
 	case err = <-l2rCh:
@@ -91,9 +202,6 @@ func serverConn(pi *ProxyItem, local net.Conn, remote net.Conn) {
 	}
 
 	log.Printf("%s to %s proxy instance exited", local.LocalAddr().String(), remote.RemoteAddr().String())
-	if pi.Instances > 0 {
-		pi.Instances--
-	}
 }
 
 type opResult struct {
@@ -103,7 +211,7 @@ type opResult struct {
 }
 
 func connRcvr(pi *ProxyItem, listener net.Listener, reqTimestamp string) {
-	protocol := pi.Type
+	protocol := pi.getRemoteType()
 	remoteAddr := pi.getRemoteAddr()
 
 	for {
@@ -113,102 +221,190 @@ func connRcvr(pi *ProxyItem, listener net.Listener, reqTimestamp string) {
 			break
 		}
 
+		if !pi.checkAcl(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
 		log.Println("Received incoming connection from", conn.RemoteAddr().String())
-		remoteConn, err := net.Dial(protocol, remoteAddr)
+		pi.stats.accepted.Add(1)
+		remoteConn, err := dialRemote(pi)
 		if err != nil {
 			fmt.Println("Failed to dial", protocol, remoteAddr, err)
+			pi.stats.dialFailed.Add(1)
+			conn.Close()
 			continue
 		}
 		log.Println("Established new connection to", remoteConn.RemoteAddr().String())
-		pi.Instances++
-		go serverConn(pi, conn, remoteConn)
+		go serverConn(pi, pi.addConn(conn.RemoteAddr(), conn, remoteConn))
 	}
 }
 
 func newProxyServer(pi *ProxyItem, startResultCh chan opResult, reqTimestamp string) {
+	acl, err := newProxyAcl(pi.Allow, pi.Deny)
+	if err != nil {
+		startResultCh <- opResult{pi, reqTimestamp, err}
+		close(startResultCh)
+		return
+	}
+	pi.acl = acl
+
+	switch pi.getMode() {
+	case MODE_LISTEN:
+		newListenProxyServer(pi, startResultCh, reqTimestamp)
+		return
+	case MODE_SLAVE:
+		newSlaveProxyServer(pi, startResultCh, reqTimestamp)
+		return
+	}
+
+	if pi.Type == "udp" {
+		newUdpProxyServer(pi, startResultCh, reqTimestamp)
+		return
+	}
+
 	protocol := pi.Type
 	addr := pi.getLocalAddr()
 	var r = opResult{pi, reqTimestamp, nil}
+	var wg sync.WaitGroup
 
-	//startResultCh
-	//stopCh
-	listener, err := net.Listen(protocol, addr)
+	listener, err := listenLocal(pi)
 	if err != nil {
 		r.err = fmt.Errorf("failed to listen on %s %s: %v", protocol, addr, err)
 		startResultCh <- r
 		close(startResultCh)
 		return
 	}
-	defer listener.Close()
 
-	//create stop ch
-	stopCh := make(chan int)
-	pi.stopCh = stopCh
-	fmt.Println("Created stopCh:", pi)
-
-	go connRcvr(pi, listener, reqTimestamp)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		connRcvr(pi, listener, reqTimestamp)
+	}()
 
 	log.Println("Started proxy:", pi)
 
 	startResultCh <- r
 	close(startResultCh)
 
-	//wait for stop signal
-	stop := <-stopCh
-	fmt.Println("Received stop proxy signal:", stop)
-
-	close(stopCh)
-	pi.Status = STATUS_STOPPED
-	pi.stopCh = nil
+	waitProxyStop(pi)
+	closeLocal(protocol, addr, listener)
+	wg.Wait()
+	pi.drainConns()
+}
 
-	log.Println("Stopped proxy:", pi)
+// wait for stop signal
+func waitProxyStop(pi *ProxyItem) {
+	<-pi.stopCh
+	fmt.Println("Received stop proxy signal:", pi.Id)
 }
 
 func (pi *ProxyItem) start() error {
+	pi.opLock.Lock()
+	defer pi.opLock.Unlock()
+	return pi.doStart()
+}
+
+func (pi *ProxyItem) doStart() error {
 	fmt.Println("Starting proxy", pi)
-	if pi.Status > STATUS_STOPPED {
+
+	pi.lock.Lock()
+	if pi.Status == STATUS_RUNNING {
+		pi.lock.Unlock()
 		fmt.Println("Proxy already started:", pi)
 		return nil
 	}
+	pi.Status = STATUS_STARTING
+	pi.stopCh = make(chan int)
+	pi.done = make(chan int)
+	done := pi.done
+	pi.lock.Unlock()
 
 	ch := make(chan opResult)
 	ts := fmt.Sprintf("%d", time.Now().Unix())
-	go newProxyServer(pi, ch, ts)
+	go func() {
+		defer close(done)
+		newProxyServer(pi, ch, ts)
+	}()
 
 	result := <-ch
+
+	pi.lock.Lock()
 	if result.err == nil {
-		pi.Status = STATUS_STARTED
+		pi.Status = STATUS_RUNNING
+		pi.LastError = ""
+	} else {
+		pi.Status = STATUS_FAILED
+		pi.LastError = result.err.Error()
+	}
+	pi.lock.Unlock()
+
+	if result.err != nil {
+		<-done
+		events.publish(EVENT_FAILED, pi, nil, result.err.Error())
+	} else {
+		events.publish(EVENT_STARTED, pi, nil, "")
 	}
 	return result.err
 }
 
-func (pi *ProxyItem) stop() {
-	fmt.Println("Stopping proxy")
-	if pi.Status == STATUS_STOPPED {
-		fmt.Println("Proxy already stopped")
-		return
-	}
+// stop proxy, return sessions drained and killed
+func (pi *ProxyItem) stop() (int, int) {
+	pi.opLock.Lock()
+	defer pi.opLock.Unlock()
+	return pi.doStop()
+}
 
-	fmt.Println("StopChan:", pi.stopCh)
-	pi.stopCh <- pi.Id
-	time.After(time.Microsecond)
-	fmt.Println("Notified proxy stop")
-	for {
-		if pi.Status == STATUS_STOPPED {
-			break
+func (pi *ProxyItem) doStop() (int, int) {
+	fmt.Println("Stopping proxy", pi.Id)
+
+	pi.lock.Lock()
+	if pi.Status != STATUS_RUNNING {
+		failed := pi.Status == STATUS_FAILED
+		if failed {
+			pi.Status = STATUS_STOPPED
+		}
+		pi.lock.Unlock()
+		if failed {
+			events.publish(EVENT_STOPPED, pi, nil, "")
 		}
-		time.After(time.Microsecond)
+		fmt.Println("Proxy already stopped")
+		return 0, 0
 	}
+	pi.Status = STATUS_STOPPING
+	pi.drained = 0
+	pi.killed = 0
+	stopCh := pi.stopCh
+	done := pi.done
+	pi.lock.Unlock()
+
+	close(stopCh)
+	<-done
+
+	pi.lock.Lock()
+	pi.Status = STATUS_STOPPED
+	drained := pi.drained
+	killed := pi.killed
+	pi.lock.Unlock()
+
+	log.Println("Stopped proxy:", pi)
+	events.publish(EVENT_STOPPED, pi, nil, "")
+	return drained, killed
 }
 
 func (pi *ProxyItem) restart() error {
+	pi.opLock.Lock()
+	defer pi.opLock.Unlock()
+
 	fmt.Println("Restarting proxy")
-	pi.stop()
-	err := pi.start()
-	return err
+	pi.doStop()
+	return pi.doStart()
 }
 
 func (pi *ProxyItem) addDefaults() {
+	if pi.Mode == "" {
+		pi.Mode = MODE_TRAN
+	}
 	if pi.Type == "" {
 		pi.Type = "tcp"
 	}
@@ -225,22 +421,72 @@ func (pi *ProxyItem) checkParam(includeId bool) error {
 		}
 	}
 
-	if pi.LocalIp == "" {
-		errstr += "No local ip\n"
+	switch pi.getMode() {
+	case MODE_TRAN:
+	case MODE_LISTEN, MODE_SLAVE:
+		if pi.Type == "udp" {
+			errstr += "Udp proxy only support tran mode\n"
+			ok = false
+		}
+	default:
+		errstr += "Unknown mode " + pi.Mode + "\n"
+		ok = false
+	}
+
+	if pi.Type == "unix" {
+		if pi.LocalPath == "" {
+			errstr += "No local socket path\n"
+			ok = false
+		}
+	} else {
+		if pi.LocalIp == "" {
+			errstr += "No local ip\n"
+			ok = false
+		}
+
+		if pi.LocalPort <= 0 || pi.LocalPort > 65535 {
+			errstr += "Invalid local port\n"
+			ok = false
+		}
+	}
+
+	_, err := newProxyAcl(pi.Allow, pi.Deny)
+	if err != nil {
+		errstr += err.Error() + "\n"
 		ok = false
 	}
 
-	if pi.LocalPort == 0 {
-		errstr += "Invalid local port\n"
+	err = checkTags(pi.Group, pi.Tags)
+	if err != nil {
+		errstr += err.Error() + "\n"
+		ok = false
 	}
 
-	if pi.RemoteIp == "" {
-		errstr += "No remote ip\n"
+	if pi.Agent != "" && pi.Type == "udp" {
+		errstr += "Udp proxy can not use agent\n"
 		ok = false
 	}
 
-	if pi.RemotePort == 0 {
-		errstr += "Invalid remote port"
+	switch pi.getRemoteType() {
+	case "unix":
+		if pi.Type == "udp" {
+			errstr += "Udp proxy can not forward to unix socket\n"
+			ok = false
+		}
+		if pi.RemotePath == "" {
+			errstr += "No remote socket path\n"
+			ok = false
+		}
+	default:
+		if pi.RemoteIp == "" {
+			errstr += "No remote ip\n"
+			ok = false
+		}
+
+		if pi.RemotePort <= 0 || pi.RemotePort > 65535 {
+			errstr += "Invalid remote port\n"
+			ok = false
+		}
 	}
 
 	if ok {
@@ -260,8 +506,15 @@ func (p *ProxyItem) ToJson() []byte {
 }
 
 type ProxyList struct {
-	pmap  map[int]*ProxyItem
-	maxId int
+	lock      sync.Mutex //protects pmap, maxId and saveTimer
+	pmap      map[int]*ProxyItem
+	maxId     int
+	saveTimer *time.Timer //pending autosave
+
+	saveLock  sync.Mutex //serializes saves, protects fields below
+	cfgFile   string
+	lastSaved []byte //content of the config file
+	readOnly  bool   //config file failed to load, do not overwrite it
 }
 
 func (pl *ProxyList) allocId() int {
@@ -282,6 +535,9 @@ func (pl *ProxyList) get(id string) (*ProxyItem, int) {
 func (pl *ProxyList) getN(id int) (*ProxyItem, int) {
 	fmt.Println("Getting proxy ", id)
 
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
 	p, ok := pl.pmap[id]
 	if ok {
 		return p, p.Id
@@ -290,22 +546,68 @@ func (pl *ProxyList) getN(id int) (*ProxyItem, int) {
 	return nil, 0
 }
 
+// get all proxy items sorted by id
+func (pl *ProxyList) list() []*ProxyItem {
+	pl.lock.Lock()
+	var items = make([]*ProxyItem, 0, len(pl.pmap))
+	for _, v := range pl.pmap {
+		items = append(items, v)
+	}
+	pl.lock.Unlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+	return items
+}
+
 func (pl *ProxyList) add(p *ProxyItem) int {
-	p.Id = pl.allocId()
+	return pl.addProxy(p, true)
+}
+
+// add a proxy, save tells whether to autosave the change
+func (pl *ProxyList) addProxy(p *ProxyItem, save bool) int {
 	p.addDefaults()
 	p.mgr = pl
+
+	//a new proxy is not started yet, whatever the request said
+	p.Status = STATUS_STOPPED
+	p.Instances = 0
+	p.LastError = ""
+
+	pl.lock.Lock()
+	p.Id = pl.allocId()
 	pl.pmap[p.Id] = p
+	pl.lock.Unlock()
+
 	fmt.Println("Added new porxy ", p)
+	events.publish(EVENT_ADDED, p, nil, "")
+	if save {
+		pl.changed()
+	}
 	return p.Id
 }
 
 func (pl *ProxyList) del(id string) error {
+	return pl.delProxy(id, true)
+}
+
+func (pl *ProxyList) delProxy(id string, save bool) error {
 	fmt.Println("Deleting proxy" + id)
 	pi, idx := pl.get(id)
-	if pi != nil {
-		delete(pl.pmap, idx)
+	if pi == nil {
+		return fmt.Errorf("proxy %s not exist", id)
 	}
 
+	pi.stop()
+
+	pl.lock.Lock()
+	delete(pl.pmap, idx)
+	pl.lock.Unlock()
+
+	sshKeys.delProxy(pi.Id)
+	events.publish(EVENT_REMOVED, pi, nil, "")
+	if save {
+		pl.changed()
+	}
 	return nil
 }
 
@@ -333,47 +635,191 @@ func updateProxy(p1 *ProxyItem, p2 *ProxyItem) bool {
 		updated = true
 	}
 
+	if p1.Mode != p2.Mode {
+		p1.Mode = p2.Mode
+		updated = true
+	}
+
 	if p1.Type != p2.Type {
 		p1.Type = p2.Type
 		updated = true
 	}
 
+	if p1.RemoteType != p2.RemoteType {
+		p1.RemoteType = p2.RemoteType
+		updated = true
+	}
+
+	if p1.LocalPath != p2.LocalPath {
+		p1.LocalPath = p2.LocalPath
+		updated = true
+	}
+
+	if p1.RemotePath != p2.RemotePath {
+		p1.RemotePath = p2.RemotePath
+		updated = true
+	}
+
+	if p1.SockMode != p2.SockMode {
+		p1.SockMode = p2.SockMode
+		updated = true
+	}
+
+	if p1.Agent != p2.Agent {
+		p1.Agent = p2.Agent
+		updated = true
+	}
+
+	if p1.UdpTimeout != p2.UdpTimeout {
+		p1.UdpTimeout = p2.UdpTimeout
+		updated = true
+	}
+
+	if !slices.Equal(p1.Allow, p2.Allow) {
+		p1.Allow = slices.Clone(p2.Allow)
+		updated = true
+	}
+
+	if !slices.Equal(p1.Deny, p2.Deny) {
+		p1.Deny = slices.Clone(p2.Deny)
+		updated = true
+	}
+
+	if p1.DrainTimeout != p2.DrainTimeout {
+		p1.DrainTimeout = p2.DrainTimeout
+		updated = true
+	}
+
 	return updated
 }
 
-func (pl *ProxyList) modify(newp *ProxyItem) {
+// update attributes of p1 which need no restart
+func updateAttrs(p1 *ProxyItem, p2 *ProxyItem) bool {
+	updated := false
+	if p1.Desc != p2.Desc {
+		p1.Desc = p2.Desc
+		updated = true
+	}
+
+	if p1.TermType != p2.TermType {
+		p1.TermType = p2.TermType
+		updated = true
+	}
+
+	if p1.SshAgentForward != p2.SshAgentForward {
+		p1.SshAgentForward = p2.SshAgentForward
+		updated = true
+	}
+
+	if p1.SshAgentAuth != p2.SshAgentAuth {
+		p1.SshAgentAuth = p2.SshAgentAuth
+		updated = true
+	}
+
+	if p1.Group != p2.Group {
+		p1.Group = p2.Group
+		updated = true
+	}
+
+	if !slices.Equal(p1.Tags, p2.Tags) {
+		p1.Tags = slices.Clone(p2.Tags)
+		updated = true
+	}
+
+	return updated
+}
+
+// test if config of p2 differs from p1
+func proxyChanged(p1 *ProxyItem, p2 *ProxyItem) bool {
+	var tmp ProxyItem
+	updateProxy(&tmp, p1)
+	return updateProxy(&tmp, p2)
+}
+
+// get a copy of config attributes
+func (pi *ProxyItem) config() *ProxyItem {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+
+	var c = &ProxyItem{Id: pi.Id}
+	updateProxy(c, pi)
+	updateAttrs(c, pi)
+	return c
+}
+
+func (pl *ProxyList) modify(newp *ProxyItem) error {
+	return pl.modifyProxy(newp, true)
+}
+
+func (pl *ProxyList) modifyProxy(newp *ProxyItem, save bool) error {
 	fmt.Println("Modifing proxy")
+	newp.addDefaults()
 
-	pi, ok := pl.pmap[newp.Id]
-	if ok {
-		/* test if changed */
-		/*
-			pi.Desc = p.Desc
-			pi.LocalIp = p.LocalIp
-			pi.LocalPort = p.LocalPort
-			pi.RemoteIp = p.RemoteIp
-			pi.RemotePort = p.RemotePort
-		*/
-		if *pi != *newp {
-			fmt.Println("Before modify: ", pi)
-			restart := updateProxy(pi, newp)
-			fmt.Println("After modify: ", newp)
-
-			/* restart proxy use new param if changed */
-			if restart {
-				err := pi.restart()
-				if err != nil {
-					fmt.Println("Failed to restart proxy:", pi)
-				} else {
-					fmt.Println("After modify2: ", pl.pmap[pi.Id])
-				}
+	pi, _ := pl.getN(newp.Id)
+	if pi == nil {
+		return fmt.Errorf("proxy %d not exist", newp.Id)
+	}
+
+	pi.opLock.Lock()
+	defer pi.opLock.Unlock()
+
+	pi.lock.Lock()
+	attrsChanged := updateAttrs(pi, newp)
+	changed := proxyChanged(pi, newp)
+	pi.lock.Unlock()
+
+	if !changed {
+		fmt.Println("ProxyItem not changed", pi)
+		if attrsChanged {
+			events.publish(EVENT_MODIFIED, pi, nil, "")
+			if save {
+				pl.changed()
 			}
-		} else {
-			fmt.Println("ProxyItem not changed", pi)
 		}
-	} else {
-		fmt.Println("proxy", newp.Id, "not exist")
+		return nil
 	}
+
+	/* stop proxy before changing its param, restart it use new param */
+	running := pi.getStatus() == STATUS_RUNNING
+	if running {
+		pi.doStop()
+	}
+
+	fmt.Println("Before modify: ", pi)
+	pi.lock.Lock()
+	updateProxy(pi, newp)
+	pi.lock.Unlock()
+	fmt.Println("After modify: ", pi)
+
+	var err error
+	if running {
+		err = pi.doStart()
+		if err != nil {
+			fmt.Println("Failed to restart proxy:", pi, err)
+		}
+	}
+
+	events.publish(EVENT_MODIFIED, pi, nil, "")
+	if save {
+		pl.changed()
+	}
+	return err
+}
+
+// stop all proxies in parallel, draining their sessions
+func (pl *ProxyList) stopAll() {
+	var wg sync.WaitGroup
+
+	for _, pi := range pl.list() {
+		wg.Add(1)
+		go func(pi *ProxyItem) {
+			defer wg.Done()
+			pi.stop()
+		}(pi)
+	}
+
+	wg.Wait()
+	log.Println("All proxies stopped")
 }
 
 // get all proxy in json format
@@ -382,7 +828,7 @@ func (pl *ProxyList) getAllProxy() []byte {
 	var first = true
 
 	buf.Write([]byte("["))
-	for _, v := range pl.pmap {
+	for _, v := range pl.list() {
 		j, e := json.Marshal(v)
 		if e != nil {
 			fmt.Println("Failed to marshal proxy:", v)
@@ -399,58 +845,3 @@ func (pl *ProxyList) getAllProxy() []byte {
 
 	return buf.Bytes()
 }
-
-func (pl *ProxyList) save(fileName string) {
-	if len(pl.pmap) < 1 {
-		fmt.Println("No config to save")
-		return
-	}
-
-	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Println("Failed to open file", fileName, "for write:", err)
-		return
-	}
-
-	defer f.Close()
-	f.Write(pl.getAllProxy())
-	fmt.Println("Config ", fileName, " saved")
-}
-
-func (pl *ProxyList) loadCfg(fileName string, autostart bool) {
-	buf, err := os.ReadFile(fileName)
-	if err != nil {
-		if err != os.ErrNotExist {
-			fmt.Println("Failed to open file", fileName, "for read:", err)
-		}
-		return
-	}
-
-	var items = make([]ProxyItem, 10)
-
-	err = json.Unmarshal(buf, &items)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	var maxid int
-	for _, p := range items {
-		if p.Id > maxid {
-			maxid = p.Id
-		}
-		p.Status = 0
-		p.Instances = 0
-		p.addDefaults()
-		p.mgr = pl
-		pl.pmap[p.Id] = &p
-
-		if autostart {
-			err = p.start()
-			if err != nil {
-				log.Println("Failed to start proxy", p, ", err:", err)
-			}
-		}
-	}
-
-	pl.maxId = maxid
-}
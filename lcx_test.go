@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// start, stop, restart and modify of one proxy from many goroutines are serialized by opLock,
+// the proxy ends in a consistent state and its port is released on stop
+func TestProxyConcurrentOps(t *testing.T) {
+	pl := newTestProxyList(t)
+	ports := []int{freePort(t), freePort(t)}
+	id := pl.add(testProxy(ports[0], "a"))
+	pi, _ := pl.getN(id)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch (i + j) % 5 {
+				case 0:
+					pi.start()
+				case 1:
+					pi.stop()
+				case 2:
+					pi.restart()
+				case 3:
+					np := testProxy(ports[j%2], "d"+strconv.Itoa(j))
+					np.Id = id
+					pl.modify(np)
+				case 4:
+					json.Marshal(pi)
+					_ = pi.String()
+					pi.getConnInfos()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	pi.start()
+	if st := pi.getStatus(); st != STATUS_RUNNING {
+		t.Fatalf("status %d after start, LastError %s", st, pi.LastError)
+	}
+
+	pi.lock.Lock()
+	port := pi.LocalPort
+	pi.lock.Unlock()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("proxy not listening:", err)
+	}
+	conn.Close()
+
+	pi.stop()
+	if st := pi.getStatus(); st != STATUS_STOPPED {
+		t.Fatalf("status %d after stop", st)
+	}
+	for _, p := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(p))
+		if err != nil {
+			t.Fatal("port not released:", err)
+		}
+		l.Close()
+	}
+}
+
+// slave dials the remote up front, so a server speaking first is heard before the client sends,
+// the next idle pair is dialed once the client sends
+func TestSlaveServerFirst(t *testing.T) {
+	pl := newTestProxyList(t)
+	listenEnd, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listenEnd.Close()
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("220 ready\r\n"))
+			go io.Copy(c, c)
+		}
+	}()
+
+	p := testProxy(listenEnd.Addr().(*net.TCPAddr).Port, "slave")
+	p.Mode = MODE_SLAVE
+	p.RemotePort = server.Addr().(*net.TCPAddr).Port
+	pi, _ := pl.getN(pl.add(p))
+	err = pi.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pi.stop()
+
+	accept := func() net.Conn {
+		t.Helper()
+		listenEnd.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		c, err := listenEnd.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+
+	c := accept()
+	defer c.Close()
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(c, buf, 11)
+	if err != nil || string(buf[:n]) != "220 ready\r\n" {
+		t.Fatalf("banner not received: %q %v", buf[:n], err)
+	}
+
+	c.Write([]byte("HELO\r\n"))
+	n, err = io.ReadAtLeast(c, buf, 6)
+	if err != nil || string(buf[:n]) != "HELO\r\n" {
+		t.Fatalf("echo not received: %q %v", buf[:n], err)
+	}
+	c2 := accept()
+	c2.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// socket mode of unix admin listeners, local administration only
+const ADMIN_SOCK_MODE = "0660"
+
+// parse listen address, "unix:/path", "host:port", "[v6]:port", "host" or ":port"
+func parseListenAddr(s string, port int) (string, string) {
+	if strings.HasPrefix(s, "unix:") {
+		return "unix", strings.TrimPrefix(s, "unix:")
+	}
+
+	_, _, err := net.SplitHostPort(s)
+	if err == nil {
+		return "tcp", s
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func listenAdmin(s string, tc *tls.Config) (net.Listener, error) {
+	network, addr := parseListenAddr(s, cfg.port)
+	if network == "unix" {
+		return listenUnix(addr, ADMIN_SOCK_MODE)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc != nil {
+		ln = tls.NewListener(ln, tc)
+	}
+	return ln, nil
+}
+
+// serve handler on each address of list, return when any server fails
+func serveAdmin(uiList string, apiList string, uiMux http.Handler, apiMux http.Handler, tc *tls.Config) error {
+	var errCh = make(chan error, 1)
+	var n = 0
+
+	serve := func(list string, h http.Handler, tips string) error {
+		for _, s := range splitList(list) {
+			ln, err := listenAdmin(s, tc)
+			if err != nil {
+				return fmt.Errorf("failed to listen %s on %s: %v", tips, s, err)
+			}
+			log.Println("Serving", tips, "on", ln.Addr().Network(), ln.Addr().String())
+
+			n++
+			go func() {
+				err := http.Serve(ln, h)
+				select {
+				case errCh <- err:
+				default:
+				}
+			}()
+		}
+		return nil
+	}
+
+	err := serve(uiList, uiMux, "UI")
+	if err != nil {
+		return err
+	}
+	err = serve(apiList, apiMux, "API")
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no listen address")
+	}
+
+	return <-errCh
+}
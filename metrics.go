@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of session duration histogram in seconds
+var durationBuckets = []float64{1, 5, 30, 60, 300, 1800, 3600, 14400, 86400}
+
+// proxyStats are counters of a proxy kept across restarts
+type proxyStats struct {
+	bytesIn    atomic.Int64 //client to upstream
+	bytesOut   atomic.Int64 //upstream to client
+	accepted   atomic.Int64
+	dialFailed atomic.Int64
+	rejected   atomic.Int64
+	durLock    sync.Mutex
+	durCounts  []int64 //per bucket, not cumulative, last one is +Inf
+	durSum     float64
+	durCount   int64
+}
+
+func (st *proxyStats) observeDuration(d time.Duration) {
+	sec := d.Seconds()
+
+	st.durLock.Lock()
+	defer st.durLock.Unlock()
+
+	if st.durCounts == nil {
+		st.durCounts = make([]int64, len(durationBuckets)+1)
+	}
+
+	idx := len(durationBuckets)
+	for i, b := range durationBuckets {
+		if sec <= b {
+			idx = i
+			break
+		}
+	}
+	st.durCounts[idx]++
+	st.durSum += sec
+	st.durCount++
+}
+
+// escape label value of prometheus text format
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+type metricWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricWriter) header(name string, mtype string, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+func (mw *metricWriter) sample(name string, labels string, value string) {
+	fmt.Fprintf(&mw.buf, "%s{%s} %s\n", name, labels, value)
+}
+
+type proxyMetric struct {
+	labels   string
+	up       int
+	active   int
+	stats    *proxyStats
+	durCount []int64
+	durSum   float64
+	durTotal int64
+}
+
+func getProxyMetrics() []proxyMetric {
+	var list []proxyMetric
+
+	for _, pi := range proxies.list() {
+		pi.lock.Lock()
+		m := proxyMetric{
+			labels: fmt.Sprintf(`id="%d",desc="%s",local="%s",remote="%s"`, pi.Id, escapeLabel(pi.Desc),
+				escapeLabel(pi.getLocalAddr()), escapeLabel(pi.getRemoteAddr())),
+			active: pi.Instances,
+			stats:  &pi.stats,
+		}
+		if pi.Status == STATUS_RUNNING {
+			m.up = 1
+		}
+		pi.lock.Unlock()
+
+		st := m.stats
+		st.durLock.Lock()
+		m.durCount = make([]int64, len(durationBuckets)+1)
+		copy(m.durCount, st.durCounts)
+		m.durSum = st.durSum
+		m.durTotal = st.durCount
+		st.durLock.Unlock()
+
+		list = append(list, m)
+	}
+
+	return list
+}
+
+func metricsHandler(resp http.ResponseWriter, req *http.Request) {
+	var mw metricWriter
+	list := getProxyMetrics()
+
+	counters := []struct {
+		name string
+		help string
+		get  func(st *proxyStats) int64
+		dir  string
+	}{
+		{"lcx_proxy_bytes_total", "Bytes forwarded by proxy.", func(st *proxyStats) int64 { return st.bytesIn.Load() }, "in"},
+		{"lcx_proxy_bytes_total", "", func(st *proxyStats) int64 { return st.bytesOut.Load() }, "out"},
+		{"lcx_proxy_connections_accepted_total", "Connections accepted by proxy.", func(st *proxyStats) int64 { return st.accepted.Load() }, ""},
+		{"lcx_proxy_dial_failures_total", "Failed dials to the remote side.", func(st *proxyStats) int64 { return st.dialFailed.Load() }, ""},
+		{"lcx_proxy_connections_rejected_total", "Connections rejected by proxy.", func(st *proxyStats) int64 { return st.rejected.Load() }, ""},
+	}
+
+	for _, c := range counters {
+		if c.help != "" {
+			mw.header(c.name, "counter", c.help)
+		}
+		for _, m := range list {
+			labels := m.labels
+			if c.dir != "" {
+				labels += `,direction="` + c.dir + `"`
+			}
+			mw.sample(c.name, labels, strconv.FormatInt(c.get(m.stats), 10))
+		}
+	}
+
+	mw.header("lcx_proxy_up", "gauge", "Whether the proxy is running.")
+	for _, m := range list {
+		mw.sample("lcx_proxy_up", m.labels, strconv.Itoa(m.up))
+	}
+
+	mw.header("lcx_proxy_active_sessions", "gauge", "Active sessions of proxy.")
+	for _, m := range list {
+		mw.sample("lcx_proxy_active_sessions", m.labels, strconv.Itoa(m.active))
+	}
+
+	mw.header("lcx_proxy_session_duration_seconds", "histogram", "Duration of finished sessions.")
+	for _, m := range list {
+		var cumulative int64
+		for i, b := range durationBuckets {
+			cumulative += m.durCount[i]
+			mw.sample("lcx_proxy_session_duration_seconds_bucket",
+				m.labels+`,le="`+strconv.FormatFloat(b, 'g', -1, 64)+`"`, strconv.FormatInt(cumulative, 10))
+		}
+		mw.sample("lcx_proxy_session_duration_seconds_bucket", m.labels+`,le="+Inf"`, strconv.FormatInt(m.durTotal, 10))
+		mw.sample("lcx_proxy_session_duration_seconds_sum", m.labels, strconv.FormatFloat(m.durSum, 'f', -1, 64))
+		mw.sample("lcx_proxy_session_duration_seconds_count", m.labels, strconv.FormatInt(m.durTotal, 10))
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	resp.Write(mw.buf.Bytes())
+}
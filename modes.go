@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxy modes, same as the -tran/-listen/-slave of classic lcx
+const (
+	MODE_TRAN   = "tran"   //listen on local, dial remote for each connection
+	MODE_LISTEN = "listen" //listen on both local and remote, pair their connections
+	MODE_SLAVE  = "slave"  //dial both local and remote, splice them
+)
+
+const (
+	SLAVE_DIAL_TIMEOUT   = 10 * time.Second
+	SLAVE_RETRY_INTERVAL = 5 * time.Second
+)
+
+func (pi *ProxyItem) getMode() string {
+	if pi.Mode == "" {
+		return MODE_TRAN
+	}
+	return pi.Mode
+}
+
+// sleep for d, return false if quit during sleep
+func sleepOrQuit(quit chan int, d time.Duration) bool {
+	select {
+	case <-quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func acceptToCh(pi *ProxyItem, listener net.Listener, ch chan net.Conn, quit chan int, tips string) {
+	defer close(ch)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println(tips, "failed to accept:", err)
+			return
+		}
+
+		if !pi.checkAcl(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
+		log.Println(tips, "received incoming connection from", conn.RemoteAddr().String())
+		select {
+		case ch <- conn:
+		case <-quit:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// pair connections accepted on local and remote side
+func connPairer(pi *ProxyItem, localCh chan net.Conn, remoteCh chan net.Conn) {
+	for {
+		local, ok := <-localCh
+		if !ok {
+			return
+		}
+
+		remote, ok := <-remoteCh
+		if !ok {
+			local.Close()
+			return
+		}
+
+		log.Println("Paired", local.RemoteAddr().String(), "with", remote.RemoteAddr().String())
+		pi.stats.accepted.Add(1)
+		go serverConn(pi, pi.addConn(local.RemoteAddr(), local, remote))
+	}
+}
+
+func newListenProxyServer(pi *ProxyItem, startResultCh chan opResult, reqTimestamp string) {
+	var r = opResult{pi, reqTimestamp, nil}
+	var wg sync.WaitGroup
+	laddr := pi.getLocalAddr()
+	raddr := pi.getRemoteAddr()
+
+	local, err := listenLocal(pi)
+	if err != nil {
+		r.err = fmt.Errorf("failed to listen on %s %s: %v", pi.Type, laddr, err)
+		startResultCh <- r
+		close(startResultCh)
+		return
+	}
+
+	remote, err := listenRemote(pi)
+	if err != nil {
+		closeLocal(pi.Type, laddr, local)
+		r.err = fmt.Errorf("failed to listen on %s %s: %v", pi.getRemoteType(), raddr, err)
+		startResultCh <- r
+		close(startResultCh)
+		return
+	}
+
+	quit := pi.stopCh
+	localCh := make(chan net.Conn)
+	remoteCh := make(chan net.Conn)
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		acceptToCh(pi, local, localCh, quit, "local")
+	}()
+	go func() {
+		defer wg.Done()
+		acceptToCh(pi, remote, remoteCh, quit, "remote")
+	}()
+	go func() {
+		defer wg.Done()
+		connPairer(pi, localCh, remoteCh)
+	}()
+
+	log.Println("Started listen proxy:", pi)
+
+	startResultCh <- r
+	close(startResultCh)
+
+	waitProxyStop(pi)
+	closeLocal(pi.Type, laddr, local)
+	closeLocal(pi.getRemoteType(), raddr, remote)
+	wg.Wait()
+	pi.drainConns()
+}
+
+// conn closing its ch on the first data read
+type firstReadConn struct {
+	net.Conn
+	once sync.Once
+	ch   chan int
+}
+
+func (c *firstReadConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() { close(c.ch) })
+	}
+	return n, err
+}
+
+// dial both local and remote up front and splice them, so protocols with server speaking first work.
+// one idle pair is kept, the next is dialed when data arrives from local side or the pair closed
+func slaveLoop(pi *ProxyItem, quit chan int) {
+	ltype := pi.Type
+	laddr := pi.getLocalAddr()
+	raddr := pi.getRemoteAddr()
+
+	for {
+		conn, err := net.DialTimeout(ltype, laddr, SLAVE_DIAL_TIMEOUT)
+		if err != nil {
+			fmt.Println("Failed to dial", ltype, laddr, err)
+			if !sleepOrQuit(quit, SLAVE_RETRY_INTERVAL) {
+				return
+			}
+			continue
+		}
+
+		remoteConn, err := dialRemote(pi)
+		if err != nil {
+			fmt.Println("Failed to dial", raddr, err)
+			pi.stats.dialFailed.Add(1)
+			conn.Close()
+			if !sleepOrQuit(quit, SLAVE_RETRY_INTERVAL) {
+				return
+			}
+			continue
+		}
+
+		log.Println("Connected", conn.RemoteAddr().String(), "with", remoteConn.RemoteAddr().String(), ", waiting for data")
+		fc := &firstReadConn{Conn: conn, ch: make(chan int)}
+		pc := pi.addConn(conn.RemoteAddr(), fc, remoteConn)
+		go serverConn(pi, pc)
+
+		select {
+		case <-fc.ch:
+		case <-pc.done:
+		case <-quit:
+		}
+
+		select {
+		case <-fc.ch:
+			pi.stats.accepted.Add(1)
+			continue
+		default:
+		}
+
+		//closed or stopping while idle, no session to drain
+		pc.close()
+		if !sleepOrQuit(quit, SLAVE_RETRY_INTERVAL) {
+			return
+		}
+	}
+}
+
+func newSlaveProxyServer(pi *ProxyItem, startResultCh chan opResult, reqTimestamp string) {
+	var r = opResult{pi, reqTimestamp, nil}
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		slaveLoop(pi, pi.stopCh)
+	}()
+
+	log.Println("Started slave proxy:", pi)
+
+	startResultCh <- r
+	close(startResultCh)
+
+	waitProxyStop(pi)
+	wg.Wait()
+	pi.drainConns()
+}
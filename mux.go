@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+)
+
+// mux frame commands, a frame is a websocket binary message:
+// cmd(1 byte) + stream id(4 bytes) + payload
+const (
+	MUX_OPEN      byte = iota + 1 //payload: "network addr"
+	MUX_OPEN_OK                   //no payload
+	MUX_OPEN_FAIL                 //payload: error message
+	MUX_DATA                      //payload: data
+	MUX_CLOSE                     //no payload
+	MUX_PING                      //no payload
+	MUX_WINDOW                    //payload: bytes consumed by reader(4 bytes)
+)
+
+const (
+	MUX_HEADER_LEN    = 5
+	MUX_MAX_DATA      = 32 * 1024
+	MUX_WINDOW_SIZE   = 256 * 1024 //unread bytes a stream may have in flight
+	MUX_OPEN_TIMEOUT  = 15 * time.Second
+	MUX_PING_INTERVAL = 30 * time.Second
+	MUX_READ_TIMEOUT  = 3 * MUX_PING_INTERVAL
+)
+
+type muxAddr struct {
+	network string
+	addr    string
+}
+
+func (a *muxAddr) Network() string { return a.network }
+func (a *muxAddr) String() string  { return a.addr }
+
+// muxStream is one connection multiplexed over the control link. Each side
+// sends at most MUX_WINDOW_SIZE bytes the peer has not read, the reader grants
+// more by MUX_WINDOW, so a slow stream never blocks the others
+type muxStream struct {
+	id      uint32
+	session *muxSession
+	laddr   net.Addr
+	raddr   net.Addr
+
+	openCh chan error
+
+	lock     sync.Mutex
+	pending  []byte   //received, not read
+	readable chan int //signaled when data arrived
+	consumed int      //read bytes not granted to peer yet
+	window   int      //bytes we may send
+	writable chan int //signaled when window grows
+
+	eofOnce   sync.Once
+	eof       chan int //remote closed
+	closeOnce sync.Once
+	closed    chan int //local closed
+}
+
+func notifyCh(ch chan int) {
+	select {
+	case ch <- 1:
+	default:
+	}
+}
+
+// queue data from peer, false if peer sent more than the window
+func (s *muxStream) push(data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.pending)+len(data) > MUX_WINDOW_SIZE {
+		return false
+	}
+	s.pending = append(s.pending, data...)
+	notifyCh(s.readable)
+	return true
+}
+
+func (s *muxStream) grow(n int) {
+	s.lock.Lock()
+	s.window += n
+	s.lock.Unlock()
+	notifyCh(s.writable)
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if len(s.pending) > 0 {
+			n := copy(p, s.pending)
+			s.pending = s.pending[n:]
+			if len(s.pending) == 0 {
+				s.pending = nil
+			}
+
+			//grant in batches to save frames
+			s.consumed += n
+			var grant int
+			if s.consumed >= MUX_WINDOW_SIZE/4 {
+				grant, s.consumed = s.consumed, 0
+			}
+			s.lock.Unlock()
+
+			if grant > 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(grant))
+				s.session.writeFrame(MUX_WINDOW, s.id, b[:])
+			}
+			return n, nil
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.readable:
+		case <-s.eof:
+			s.lock.Lock()
+			empty := len(s.pending) == 0
+			s.lock.Unlock()
+			if empty {
+				return 0, io.EOF
+			}
+		case <-s.closed:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		select {
+		case <-s.closed:
+			return written, net.ErrClosed
+		case <-s.eof:
+			return written, io.ErrClosedPipe
+		default:
+		}
+
+		s.lock.Lock()
+		n := min(len(p), MUX_MAX_DATA, s.window)
+		s.window -= n
+		s.lock.Unlock()
+
+		if n == 0 {
+			//wait for peer to read
+			select {
+			case <-s.writable:
+			case <-s.closed:
+				return written, net.ErrClosed
+			case <-s.eof:
+				return written, io.ErrClosedPipe
+			}
+			continue
+		}
+
+		err := s.session.writeFrame(MUX_DATA, s.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (s *muxStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.session.delStream(s) {
+			s.session.writeFrame(MUX_CLOSE, s.id, nil)
+		}
+	})
+	return nil
+}
+
+func (s *muxStream) remoteClose() {
+	s.eofOnce.Do(func() {
+		close(s.eof)
+	})
+}
+
+func (s *muxStream) LocalAddr() net.Addr                { return s.laddr }
+func (s *muxStream) RemoteAddr() net.Addr               { return s.raddr }
+func (s *muxStream) SetDeadline(t time.Time) error      { return nil }
+func (s *muxStream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *muxStream) SetWriteDeadline(t time.Time) error { return nil }
+
+// muxSession multiplexes streams over a websocket connection
+type muxSession struct {
+	conn     net.Conn
+	rd       io.ReadWriter
+	isClient bool
+	name     string
+
+	wlock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint32]*muxStream
+	nextId  uint32
+	closed  bool
+
+	//called on MUX_OPEN from peer, agent side only
+	onOpen func(s *muxStream, network string, addr string)
+}
+
+func newMuxSession(conn net.Conn, rd io.ReadWriter, isClient bool, name string) *muxSession {
+	return &muxSession{
+		conn:     conn,
+		rd:       rd,
+		isClient: isClient,
+		name:     name,
+		streams:  make(map[uint32]*muxStream),
+	}
+}
+
+func (ms *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	var frame = make([]byte, MUX_HEADER_LEN+len(payload))
+	frame[0] = cmd
+	binary.BigEndian.PutUint32(frame[1:MUX_HEADER_LEN], id)
+	copy(frame[MUX_HEADER_LEN:], payload)
+
+	ms.wlock.Lock()
+	defer ms.wlock.Unlock()
+
+	if ms.isClient {
+		return wsutil.WriteClientBinary(ms.conn, frame)
+	}
+	return wsutil.WriteServerBinary(ms.conn, frame)
+}
+
+func (ms *muxSession) readFrame() (byte, uint32, []byte, error) {
+	var frame []byte
+	var err error
+
+	ms.conn.SetReadDeadline(time.Now().Add(MUX_READ_TIMEOUT))
+	if ms.isClient {
+		frame, _, err = wsutil.ReadServerData(ms.rd)
+	} else {
+		frame, _, err = wsutil.ReadClientData(ms.rd)
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if len(frame) < MUX_HEADER_LEN {
+		return 0, 0, nil, fmt.Errorf("short mux frame, len %d", len(frame))
+	}
+
+	return frame[0], binary.BigEndian.Uint32(frame[1:MUX_HEADER_LEN]), frame[MUX_HEADER_LEN:], nil
+}
+
+func (ms *muxSession) newStream(id uint32, network string, addr string) *muxStream {
+	return &muxStream{
+		id:       id,
+		session:  ms,
+		laddr:    &muxAddr{"mux", ms.name},
+		raddr:    &muxAddr{network, addr},
+		openCh:   make(chan error, 1),
+		readable: make(chan int, 1),
+		window:   MUX_WINDOW_SIZE,
+		writable: make(chan int, 1),
+		eof:      make(chan int),
+		closed:   make(chan int),
+	}
+}
+
+func (ms *muxSession) getStream(id uint32) *muxStream {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.streams[id]
+}
+
+// remove stream, return false if already removed
+func (ms *muxSession) delStream(s *muxStream) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if ms.streams[s.id] != s {
+		return false
+	}
+	delete(ms.streams, s.id)
+	return true
+}
+
+func (ms *muxSession) streamCount() int {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return len(ms.streams)
+}
+
+// open a stream to network addr on the peer
+func (ms *muxSession) open(network string, addr string) (net.Conn, error) {
+	ms.lock.Lock()
+	if ms.closed {
+		ms.lock.Unlock()
+		return nil, fmt.Errorf("agent %s link closed", ms.name)
+	}
+	ms.nextId++
+	s := ms.newStream(ms.nextId, network, addr)
+	ms.streams[s.id] = s
+	ms.lock.Unlock()
+
+	err := ms.writeFrame(MUX_OPEN, s.id, []byte(network+" "+addr))
+	if err == nil {
+		select {
+		case err = <-s.openCh:
+		case <-time.After(MUX_OPEN_TIMEOUT):
+			err = fmt.Errorf("timeout")
+		}
+	}
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("agent %s failed to dial %s %s: %v", ms.name, network, addr, err)
+	}
+
+	return s, nil
+}
+
+func (ms *muxSession) pingLoop(done chan int) {
+	ticker := time.NewTicker(MUX_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := ms.writeFrame(MUX_PING, 0, nil)
+			if err != nil {
+				fmt.Println("Failed to ping", ms.name, err)
+				ms.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// read frames and dispatch them to streams until the link is broken
+func (ms *muxSession) serve() error {
+	done := make(chan int)
+	defer close(done)
+	defer ms.close()
+	go ms.pingLoop(done)
+
+	for {
+		cmd, id, payload, err := ms.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case MUX_OPEN:
+			if ms.onOpen == nil {
+				ms.writeFrame(MUX_OPEN_FAIL, id, []byte("open not supported"))
+				continue
+			}
+			network, addr, ok := strings.Cut(string(payload), " ")
+			if !ok {
+				ms.writeFrame(MUX_OPEN_FAIL, id, []byte("invalid address"))
+				continue
+			}
+			s := ms.newStream(id, network, addr)
+			ms.lock.Lock()
+			ms.streams[id] = s
+			ms.lock.Unlock()
+			go ms.onOpen(s, network, addr)
+		case MUX_OPEN_OK, MUX_OPEN_FAIL:
+			s := ms.getStream(id)
+			if s == nil {
+				continue
+			}
+			var err error
+			if cmd == MUX_OPEN_FAIL {
+				err = fmt.Errorf("%s", payload)
+			}
+			//a duplicate or late reply must not block the link
+			select {
+			case s.openCh <- err:
+			default:
+			}
+		case MUX_DATA:
+			s := ms.getStream(id)
+			if s == nil {
+				continue
+			}
+			if !s.push(payload) {
+				fmt.Println("Stream", id, "of", ms.name, "exceeded window, reset")
+				if ms.delStream(s) {
+					ms.writeFrame(MUX_CLOSE, id, nil)
+				}
+				s.remoteClose()
+			}
+		case MUX_WINDOW:
+			s := ms.getStream(id)
+			if s != nil && len(payload) == 4 {
+				s.grow(int(binary.BigEndian.Uint32(payload)))
+			}
+		case MUX_CLOSE:
+			s := ms.getStream(id)
+			if s != nil {
+				ms.delStream(s)
+				s.remoteClose()
+			}
+		case MUX_PING:
+		default:
+			fmt.Println("Unknown mux command", cmd, "from", ms.name)
+		}
+	}
+}
+
+// close the link and all streams on it
+func (ms *muxSession) close() {
+	ms.lock.Lock()
+	ms.closed = true
+	streams := ms.streams
+	ms.streams = make(map[uint32]*muxStream)
+	ms.lock.Unlock()
+
+	for _, s := range streams {
+		select {
+		case s.openCh <- fmt.Errorf("agent %s link closed", ms.name):
+		default:
+		}
+		s.remoteClose()
+	}
+	ms.conn.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// controller and agent sessions over a pipe, agent handles opens with onOpen
+func newTestMux(t *testing.T, onOpen func(s *muxStream, network string, addr string)) *muxSession {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	ctl := newMuxSession(c1, c1, false, "ctl")
+	agent := newMuxSession(c2, c2, true, "agent")
+	agent.onOpen = onOpen
+	go ctl.serve()
+	go agent.serve()
+	t.Cleanup(func() {
+		ctl.close()
+		agent.close()
+	})
+	return ctl
+}
+
+func TestMuxSlowStream(t *testing.T) {
+	const size = 4 << 20
+	var received = make(chan int64, 1)
+
+	ctl := newTestMux(t, func(s *muxStream, network string, addr string) {
+		s.session.writeFrame(MUX_OPEN_OK, s.id, nil)
+		if addr == "slow" {
+			//never read
+			return
+		}
+		n, _ := io.Copy(io.Discard, s)
+		received <- n
+	})
+
+	slow, err := ctl.open("tcp", "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go slow.Write(make([]byte, size))
+
+	fast, err := ctl.open("tcp", "fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		fast.Write(make([]byte, size))
+		fast.Close()
+	}()
+
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatalf("received %d bytes, want %d", n, size)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("fast stream blocked by slow stream")
+	}
+}
+
+func TestMuxWindowOverflow(t *testing.T) {
+	var opened = make(chan *muxStream, 1)
+	ctl := newTestMux(t, func(s *muxStream, network string, addr string) {
+		s.session.writeFrame(MUX_OPEN_OK, s.id, nil)
+		opened <- s
+	})
+
+	c, err := ctl.open("tcp", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-opened
+
+	//a peer ignoring the window gets the stream reset
+	for i := 0; i <= MUX_WINDOW_SIZE/MUX_MAX_DATA; i++ {
+		ctl.writeFrame(MUX_DATA, c.(*muxStream).id, make([]byte, MUX_MAX_DATA))
+	}
+	select {
+	case <-s.eof:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not reset")
+	}
+	select {
+	case <-c.(*muxStream).eof:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset not sent to peer")
+	}
+}
+
+func TestMuxDuplicateOpenReply(t *testing.T) {
+	ctl := newTestMux(t, func(s *muxStream, network string, addr string) {
+		for i := 0; i < 3; i++ {
+			s.session.writeFrame(MUX_OPEN_OK, s.id, nil)
+		}
+		s.session.writeFrame(MUX_OPEN_FAIL, s.id, []byte("late"))
+	})
+
+	for _, addr := range []string{"a", "b"} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := ctl.open("tcp", addr)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("link blocked by duplicate open reply")
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var openApiDoc []byte
+
+// go types of schemas in openapi.json
+var openApiSchemas = map[string]reflect.Type{
+	"ProxyItem":      reflect.TypeOf(ProxyItem{}),
+	"ConnInfo":       reflect.TypeOf(ConnInfo{}),
+	"ActionResponse": reflect.TypeOf(apiActionRsp{}),
+	"Error":          reflect.TypeOf(apiError{}),
+	"ErrorResponse":  reflect.TypeOf(apiErrorRsp{}),
+	"LoginRequest":   reflect.TypeOf(loginReq{}),
+	"LoginResponse":  reflect.TypeOf(loginRsp{}),
+	"User":           reflect.TypeOf(authUser{}),
+	"Event":          reflect.TypeOf(Event{}),
+	"ReloadResult":   reflect.TypeOf(ReloadResult{}),
+	"Config":         reflect.TypeOf(proxyConfig{}),
+	"BulkResult":     reflect.TypeOf(apiBulkResult{}),
+	"BulkResponse":   reflect.TypeOf(apiBulkRsp{}),
+	"SshKey":         reflect.TypeOf(SshKey{}),
+	"SshKeyRequest":  reflect.TypeOf(sshKeyReq{}),
+	"HostKey":        reflect.TypeOf(HostKey{}),
+	"HostKeyChange":  reflect.TypeOf(HostKeyChange{}),
+	"Recording":      reflect.TypeOf(Recording{}),
+	"TermSession":    reflect.TypeOf(TermSession{}),
+	"TermObserver":   reflect.TypeOf(TermObserver{}),
+	"AgentInfo":      reflect.TypeOf(AgentInfo{}),
+	"LegacyResult":   reflect.TypeOf(errRsp{}),
+}
+
+var openApiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type openApiSchema struct {
+	Type       string
+	Ref        string `json:"$ref"`
+	Properties map[string]*openApiSchema
+	Items      *openApiSchema
+}
+
+type openApiSpec struct {
+	Paths      map[string]map[string]json.RawMessage
+	Components struct {
+		Schemas map[string]*openApiSchema
+	}
+}
+
+func openApiHandler(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(openApiDoc)
+}
+
+// json field names of struct type, same rules as encoding/json
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	var fields = make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name := f.Name
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			name = tag
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func schemaName(ref string) string {
+	return strings.TrimPrefix(ref, "#/components/schemas/")
+}
+
+// check schema s describes go type t
+func checkSchemaType(where string, s *openApiSchema, t reflect.Type) []string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		//raw json, any schema
+		return nil
+	}
+
+	if s.Ref != "" {
+		rt, ok := openApiSchemas[schemaName(s.Ref)]
+		if !ok || rt != t {
+			return []string{fmt.Sprintf("%s: %s does not describe %s", where, s.Ref, t)}
+		}
+		return nil
+	}
+
+	var want string
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		want = "integer"
+	case reflect.Float32, reflect.Float64:
+		want = "number"
+	case reflect.String:
+		want = "string"
+	case reflect.Bool:
+		want = "boolean"
+	case reflect.Slice, reflect.Array:
+		want = "array"
+	default:
+		want = "object"
+	}
+
+	if s.Type != want {
+		return []string{fmt.Sprintf("%s: type is %q, %s needs %q", where, s.Type, t, want)}
+	}
+	if want == "array" && s.Items != nil {
+		return checkSchemaType(where+"[]", s.Items, t.Elem())
+	}
+	return nil
+}
+
+func checkSchema(name string, s *openApiSchema, t reflect.Type) []string {
+	var errs []string
+	fields := jsonFields(t)
+
+	for fname, ft := range fields {
+		ps, ok := s.Properties[fname]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("schema %s: missing property %s of %s", name, fname, t))
+			continue
+		}
+		errs = append(errs, checkSchemaType("schema "+name+"."+fname, ps, ft)...)
+	}
+
+	for pname := range s.Properties {
+		if _, ok := fields[pname]; !ok {
+			errs = append(errs, fmt.Sprintf("schema %s: property %s not in %s", name, pname, t))
+		}
+	}
+
+	return errs
+}
+
+// check openapi.json against registered routes and go types, return the mismatches
+func checkOpenApi() []string {
+	var spec openApiSpec
+	var errs []string
+
+	err := json.Unmarshal(openApiDoc, &spec)
+	if err != nil {
+		return []string{"invalid openapi.json: " + err.Error()}
+	}
+
+	var routes = make(map[string]bool)
+	for _, r := range append(getApiRoutes(), getLegacyRoutes()...) {
+		routes[r.Path] = true
+		item, ok := spec.Paths[r.Path]
+		if !ok {
+			errs = append(errs, "route "+r.Path+" not in spec")
+			continue
+		}
+
+		var specMethods []string
+		for m := range item {
+			if slices.Contains(openApiMethods, m) {
+				specMethods = append(specMethods, strings.ToUpper(m))
+			}
+		}
+		routeMethods := slices.Clone(r.Methods)
+		sort.Strings(specMethods)
+		sort.Strings(routeMethods)
+		if !slices.Equal(specMethods, routeMethods) {
+			errs = append(errs, fmt.Sprintf("route %s: methods %v, spec has %v", r.Path, routeMethods, specMethods))
+		}
+	}
+
+	for path := range spec.Paths {
+		if !routes[path] {
+			errs = append(errs, "spec path "+path+" is not registered")
+		}
+	}
+
+	for name, t := range openApiSchemas {
+		s, ok := spec.Components.Schemas[name]
+		if !ok {
+			errs = append(errs, "schema "+name+" not in spec")
+			continue
+		}
+		errs = append(errs, checkSchema(name, s, t)...)
+	}
+
+	for name := range spec.Components.Schemas {
+		if _, ok := openApiSchemas[name]; !ok {
+			errs = append(errs, "schema "+name+" has no go type")
+		}
+	}
+
+	sort.Strings(errs)
+	return errs
+}
+
+// run by -checkapi, exit code is not zero if spec drifts
+func runCheckApi() int {
+	errs := checkOpenApi()
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+
+	if len(errs) > 0 {
+		fmt.Println("openapi.json check failed,", len(errs), "errors")
+		return 1
+	}
+	fmt.Println("openapi.json check passed")
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenApiCheck(t *testing.T) {
+	for _, e := range checkOpenApi() {
+		t.Error(e)
+	}
+}
+
+// every path in openapi.json is served by newApiMux under the same pattern,
+// and every route of the tables is registered in it
+func TestOpenApiRoutes(t *testing.T) {
+	var spec openApiSpec
+	err := json.Unmarshal(openApiDoc, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := newApiMux()
+	wildcard := regexp.MustCompile(`\{[^}]+\}`)
+	check := func(path string, method string) {
+		req := httptest.NewRequest(method, wildcard.ReplaceAllString(path, "1"), nil)
+		_, pattern := mux.Handler(req)
+		if pattern != path {
+			t.Errorf("%s %s is served by %q", method, path, pattern)
+		}
+	}
+
+	for path, item := range spec.Paths {
+		for m := range item {
+			if slices.Contains(openApiMethods, m) {
+				check(path, strings.ToUpper(m))
+			}
+		}
+	}
+
+	for _, r := range append(getApiRoutes(), getLegacyRoutes()...) {
+		for _, m := range r.Methods {
+			check(r.Path, m)
+		}
+	}
+}
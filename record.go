@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RECORD_EXT = ".cast"
+
+// id of recording is its file name without extension
+var recordIdRe = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.-]*$`)
+
+// default -recordmask, input after a matching prompt is masked
+const RECORD_MASK_DEFAULT = `(?i)(password|passphrase|passcode|pin|otp|token|verification code|密码)[^\r\n]*[:：]\s*$`
+
+// escape sequences removed from output before matching prompt
+var ansiEscapeRe = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// asciicast v2 header, players ignore the extra fields of lcx
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	User      string            `json:"user"`
+	ProxyId   int               `json:"proxy_id"`
+	Target    string            `json:"target"`
+	TermType  string            `json:"term_type"`
+}
+
+// Recording is a recorded web terminal session
+type Recording struct {
+	Id       string
+	User     string //web user who opened the terminal
+	ProxyId  int
+	Target   string
+	TermType string
+	Start    string
+	Duration int //seconds
+	Size     int64
+	Active   bool //session still running
+}
+
+// termRecorder writes output, input and resizes of a terminal session. Input
+// events have the web user who typed it as 4th element, input after a prompt
+// of -recordmask is masked since the remote does not echo it
+type termRecorder struct {
+	lock     sync.Mutex
+	id       string
+	file     *os.File
+	start    time.Time
+	lastLine string //tail of output after the last line break
+}
+
+type RecordMgr struct {
+	lock   sync.Mutex
+	dir    string
+	mask   *regexp.Regexp //prompts of no echo input, nil if not masked
+	active map[string]bool
+}
+
+var recordings = &RecordMgr{active: make(map[string]bool)}
+
+// start recording session of proxy, nil if recording is off or failed
+func (rm *RecordMgr) start(p *ProxyItem, user string, cols int, rows int) *termRecorder {
+	if rm.dir == "" {
+		return nil
+	}
+
+	_, _, termType := p.getTermTarget()
+	addr := p.getTermRemote()
+	now := time.Now()
+	id := now.Format("20060102-150405.000") + "-" + strconv.Itoa(p.Id)
+	f, err := os.OpenFile(filepath.Join(rm.dir, id+RECORD_EXT), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Println("Failed to create recording", id, err)
+		return nil
+	}
+
+	var h = castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: now.Unix(),
+		Title:     user + "@" + addr,
+		Env:       map[string]string{"TERM": "xterm"},
+		User:      user,
+		ProxyId:   p.Id,
+		Target:    addr,
+		TermType:  termType,
+	}
+	j, _ := json.Marshal(h)
+	_, err = f.Write(append(j, '\n'))
+	if err != nil {
+		log.Println("Failed to write recording", id, err)
+		f.Close()
+		return nil
+	}
+
+	rm.lock.Lock()
+	rm.active[id] = true
+	rm.lock.Unlock()
+	log.Println("Recording terminal session of user", user, "proxy", p.Id, "to", id)
+
+	go rm.cleanup()
+	return &termRecorder{id: id, file: f, start: now}
+}
+
+// write [time, type, data, extra...] line
+func (r *termRecorder) event(typ string, data string, extra ...any) {
+	j, _ := json.Marshal(append([]any{time.Since(r.start).Seconds(), typ, data}, extra...))
+	_, err := r.file.Write(append(j, '\n'))
+	if err != nil {
+		fmt.Println("Failed to write recording", r.id, err)
+	}
+}
+
+func (r *termRecorder) output(p []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return
+	}
+	r.event("o", string(p))
+
+	line := r.lastLine + string(p)
+	if i := strings.LastIndexAny(line, "\r\n"); i >= 0 {
+		line = line[i+1:]
+	}
+	if len(line) > 256 {
+		line = line[len(line)-256:]
+	}
+	r.lastLine = line
+}
+
+// replace printable chars with *, keep enter and other control chars
+func maskInput(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f {
+			return c
+		}
+		return '*'
+	}, s)
+}
+
+// record input typed by user
+func (r *termRecorder) input(p []byte, user string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return
+	}
+	data := string(p)
+	if recordings.mask != nil && recordings.mask.MatchString(ansiEscapeRe.ReplaceAllString(r.lastLine, "")) {
+		data = maskInput(data)
+	}
+	r.event("i", data, user)
+}
+
+func (r *termRecorder) resize(cols int, rows int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file != nil {
+		r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+	}
+}
+
+func (r *termRecorder) close() {
+	r.lock.Lock()
+	if r.file == nil {
+		r.lock.Unlock()
+		return
+	}
+	r.file.Close()
+	r.file = nil
+	r.lock.Unlock()
+
+	recordings.lock.Lock()
+	delete(recordings.active, r.id)
+	recordings.lock.Unlock()
+	log.Println("Recording", r.id, "finished")
+}
+
+func (rm *RecordMgr) path(id string) string {
+	return filepath.Join(rm.dir, id+RECORD_EXT)
+}
+
+// read header of recording file
+func (rm *RecordMgr) info(id string) (*Recording, error) {
+	f, err := os.Open(rm.path(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var h castHeader
+	err = json.Unmarshal(line, &h)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Unix(h.Timestamp, 0)
+	rm.lock.Lock()
+	active := rm.active[id]
+	rm.lock.Unlock()
+	return &Recording{
+		Id:       id,
+		User:     h.User,
+		ProxyId:  h.ProxyId,
+		Target:   h.Target,
+		TermType: h.TermType,
+		Start:    start.Format(time.RFC3339),
+		Duration: int(st.ModTime().Sub(start).Seconds()),
+		Size:     st.Size(),
+		Active:   active,
+	}, nil
+}
+
+// recordings visible to user, newest first, nil user sees all
+func (rm *RecordMgr) list(u *authUser) []Recording {
+	var list = []Recording{}
+	if rm.dir == "" {
+		return list
+	}
+
+	entries, err := os.ReadDir(rm.dir)
+	if err != nil {
+		log.Println("Failed to read recordings dir", rm.dir, err)
+		return list
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), RECORD_EXT)
+		if !ok || e.IsDir() {
+			continue
+		}
+		r, err := rm.info(id)
+		if err != nil {
+			continue
+		}
+		if u == nil || u.roleLevel() >= ROLE_ADMIN || r.User == u.Name {
+			list = append(list, *r)
+		}
+	}
+
+	slices.Reverse(list)
+	return list
+}
+
+// remove finished recordings older than -recorddays, then oldest ones until
+// total size is below -recordmaxsize
+func (rm *RecordMgr) cleanup() {
+	if rm.dir == "" || (cfg.recordDays <= 0 && cfg.recordMaxSize <= 0) {
+		return
+	}
+
+	entries, err := os.ReadDir(rm.dir)
+	if err != nil {
+		log.Println("Failed to read recordings dir", rm.dir, err)
+		return
+	}
+
+	type castFile struct {
+		id    string
+		size  int64
+		mtime time.Time
+	}
+	var files []castFile
+	var total int64
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), RECORD_EXT)
+		if !ok || e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, castFile{id, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	slices.SortFunc(files, func(a, b castFile) int { return a.mtime.Compare(b.mtime) })
+
+	deadline := time.Now().AddDate(0, 0, -cfg.recordDays)
+	maxSize := int64(cfg.recordMaxSize) << 20
+	for _, f := range files {
+		expired := cfg.recordDays > 0 && f.mtime.Before(deadline)
+		oversize := cfg.recordMaxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			break
+		}
+
+		rm.lock.Lock()
+		active := rm.active[f.id]
+		rm.lock.Unlock()
+		if active {
+			continue
+		}
+
+		err = os.Remove(rm.path(f.id))
+		if err != nil {
+			log.Println("Failed to remove recording", f.id, err)
+			continue
+		}
+		total -= f.size
+		log.Println("Removed recording", f.id, "by retention")
+	}
+}
+
+func initRecordings() {
+	if cfg.recordDir == "" {
+		return
+	}
+
+	err := os.MkdirAll(cfg.recordDir, 0700)
+	if err != nil {
+		log.Println("Failed to create recordings dir", cfg.recordDir, err, ", recording is off")
+		return
+	}
+	recordings.dir = cfg.recordDir
+	if cfg.recordMask != "" {
+		recordings.mask, err = regexp.Compile(cfg.recordMask)
+		if err != nil {
+			log.Fatalln("Invalid -recordmask", cfg.recordMask, err)
+		}
+	}
+
+	go func() {
+		for {
+			recordings.cleanup()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// get recording of /api/v2/recordings/{id} which user can access, error is written
+func getApiRecording(resp http.ResponseWriter, req *http.Request) *Recording {
+	id := req.PathValue("id")
+	var r *Recording
+	if recordings.dir != "" && recordIdRe.MatchString(id) {
+		r, _ = recordings.info(id)
+	}
+	if r == nil {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "Recording "+id+" not found")
+		return nil
+	}
+
+	u := getReqUser(req)
+	if u != nil && u.roleLevel() < ROLE_ADMIN && r.User != u.Name {
+		writeApiError(resp, http.StatusForbidden, API_ERR_FORBIDDEN, "Not owner of recording")
+		return nil
+	}
+	return r
+}
+
+// /api/v2/recordings
+func apiRecordingsHandler(resp http.ResponseWriter, req *http.Request) {
+	writeApiJson(resp, http.StatusOK, recordings.list(getReqUser(req)))
+}
+
+// /api/v2/recordings/{id}, GET returns the asciicast file
+func apiRecordingHandler(resp http.ResponseWriter, req *http.Request) {
+	r := getApiRecording(resp, req)
+	if r == nil {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		resp.Header().Set("Content-Type", "application/x-asciicast")
+		resp.Header().Set("Content-Disposition", "inline; filename=\""+r.Id+RECORD_EXT+"\"")
+		http.ServeFile(resp, req, recordings.path(r.Id))
+	case http.MethodDelete:
+		if r.Active {
+			writeApiError(resp, http.StatusConflict, API_ERR_INVALID_PARAM, "Recording "+r.Id+" is active")
+			return
+		}
+		err := os.Remove(recordings.path(r.Id))
+		if err != nil {
+			writeApiError(resp, http.StatusInternalServerError, API_ERR_INTERNAL_ERROR, err.Error())
+			return
+		}
+		log.Println("User", getReqUserName(req), "deleted recording", r.Id)
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wait for the writer to finish before reload
+const RELOAD_DELAY = 300 * time.Millisecond
+
+// how a proxy set is applied to the running proxies
+const (
+	APPLY_RELOAD  = "reload"  //match by id, remove proxies not in the set
+	APPLY_MERGE   = "merge"   //match by local address, keep proxies not in the set
+	APPLY_REPLACE = "replace" //match by local address, remove proxies not in the set
+)
+
+// ReloadResult is the summary of a config reload or import, ids of affected proxies
+type ReloadResult struct {
+	DryRun    bool
+	Added     []int //0 for new proxies in dry run
+	Removed   []int
+	Modified  []int
+	Unchanged []int
+	Changes   []string //readable diff
+	Errors    []string
+
+	newIds bool //proxies without id in the set got new ids
+}
+
+func (rr *ReloadResult) String() string {
+	s := fmt.Sprintf("added %v, removed %v, modified %v, unchanged %d", rr.Added, rr.Removed, rr.Modified, len(rr.Unchanged))
+	if len(rr.Errors) > 0 {
+		s += ", errors: " + strings.Join(rr.Errors, "; ")
+	}
+	return s
+}
+
+var reloadTimer struct {
+	lock  sync.Mutex
+	timer *time.Timer
+}
+
+// reload config after the file stopped changing
+func scheduleReload() {
+	reloadTimer.lock.Lock()
+	defer reloadTimer.lock.Unlock()
+
+	if reloadTimer.timer == nil {
+		reloadTimer.timer = time.AfterFunc(RELOAD_DELAY, func() {
+			reloadTimer.lock.Lock()
+			reloadTimer.timer = nil
+			reloadTimer.lock.Unlock()
+			proxies.reload()
+		})
+	} else {
+		reloadTimer.timer.Reset(RELOAD_DELAY)
+	}
+}
+
+func configMap(p *ProxyItem) map[string]any {
+	var m map[string]any
+	json.Unmarshal(p.ToJson(), &m)
+	delete(m, "Id")
+	for _, k := range runtimeAttrs {
+		delete(m, k)
+	}
+	for k, v := range m {
+		if a, ok := v.([]any); ok && len(a) == 0 {
+			m[k] = nil //same as empty list
+		}
+	}
+	return m
+}
+
+// readable differences of config from p1 to p2
+func configDiff(p1 *ProxyItem, p2 *ProxyItem) []string {
+	var diffs []string
+	m1 := configMap(p1)
+	m2 := configMap(p2)
+
+	for k, v2 := range m2 {
+		v1 := m1[k]
+		if !reflect.DeepEqual(v1, v2) {
+			diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", k, v1, v2))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// key of a proxy when matching by local address
+func localKey(p *ProxyItem) string {
+	return p.Type + " " + p.getLocalAddr()
+}
+
+func proxySummary(p *ProxyItem) string {
+	s := fmt.Sprintf("%s %s %s -> %s %s", p.getMode(), p.Type, p.getLocalAddr(), p.getRemoteType(), p.getRemoteAddr())
+	if p.Desc != "" {
+		s += " (" + p.Desc + ")"
+	}
+	return s
+}
+
+// insert a proxy loaded from config, keep its id
+func (pl *ProxyList) insert(p *ProxyItem) {
+	p.Status = STATUS_STOPPED
+	p.Instances = 0
+	p.addDefaults()
+	p.mgr = pl
+
+	pl.lock.Lock()
+	if p.Id > pl.maxId {
+		pl.maxId = p.Id
+	}
+	pl.pmap[p.Id] = p
+	pl.lock.Unlock()
+
+	events.publish(EVENT_ADDED, p, nil, "")
+}
+
+// add, modify and remove proxies to match items, through the same path as api changes.
+// changes of a reload are not autosaved, the file is already their source
+func (pl *ProxyList) apply(items []*ProxyItem, mode string, dryRun bool) *ReloadResult {
+	var rr = &ReloadResult{DryRun: dryRun}
+	var save = mode != APPLY_RELOAD
+	var current = make(map[string]*ProxyItem)
+	var keep = make(map[int]bool)
+	var seen = make(map[string]bool)
+
+	for _, pi := range pl.list() {
+		if mode == APPLY_RELOAD {
+			current[strconv.Itoa(pi.Id)] = pi
+		} else {
+			current[localKey(pi.config())] = pi
+		}
+	}
+
+	for _, p := range items {
+		p.addDefaults()
+
+		var key string
+		if mode == APPLY_RELOAD {
+			key = strconv.Itoa(p.Id)
+		} else {
+			key = localKey(p)
+		}
+
+		old := current[key]
+		if p.Id == 0 && mode == APPLY_RELOAD {
+			key = "new " + strconv.Itoa(len(seen))
+		}
+		if seen[key] {
+			rr.Errors = append(rr.Errors, "duplicate proxy "+key)
+			continue
+		}
+		seen[key] = true
+		if old != nil {
+			keep[old.Id] = true //keep it even if invalid
+		}
+
+		err := p.checkParam(false)
+		if err != nil {
+			rr.Errors = append(rr.Errors, fmt.Sprintf("proxy %s: %s", key, strings.ReplaceAll(strings.TrimSpace(err.Error()), "\n", ", ")))
+			continue
+		}
+
+		//only take config attributes
+		var np = &ProxyItem{}
+		updateProxy(np, p)
+		updateAttrs(np, p)
+
+		if old == nil {
+			rr.Changes = append(rr.Changes, "add "+proxySummary(np))
+			if dryRun {
+				rr.Added = append(rr.Added, 0)
+				continue
+			}
+
+			if mode == APPLY_RELOAD && p.Id != 0 {
+				np.Id = p.Id
+				pl.insert(np)
+			} else {
+				pl.addProxy(np, save)
+				rr.newIds = true
+			}
+			keep[np.Id] = true
+			rr.Added = append(rr.Added, np.Id)
+			if cfg.autoStart {
+				np.start()
+			}
+			continue
+		}
+
+		np.Id = old.Id
+		diffs := configDiff(old.config(), np)
+		if len(diffs) == 0 {
+			rr.Unchanged = append(rr.Unchanged, old.Id)
+			continue
+		}
+
+		rr.Modified = append(rr.Modified, old.Id)
+		rr.Changes = append(rr.Changes, fmt.Sprintf("modify %d: %s", old.Id, strings.Join(diffs, ", ")))
+		if dryRun {
+			continue
+		}
+
+		err = pl.modifyProxy(np, save)
+		if err != nil {
+			rr.Errors = append(rr.Errors, fmt.Sprintf("proxy %d: %v", old.Id, err))
+		}
+	}
+
+	if mode != APPLY_MERGE {
+		for _, pi := range pl.list() {
+			if keep[pi.Id] {
+				continue
+			}
+
+			rr.Removed = append(rr.Removed, pi.Id)
+			rr.Changes = append(rr.Changes, fmt.Sprintf("remove %d: %s", pi.Id, proxySummary(pi.config())))
+			if !dryRun {
+				pl.delProxy(strconv.Itoa(pi.Id), save)
+			}
+		}
+	}
+
+	return rr
+}
+
+// reload config file, apply the differences to running proxies
+func (pl *ProxyList) reload() *ReloadResult {
+	var rr = &ReloadResult{}
+
+	pl.saveLock.Lock()
+	fileName := pl.cfgFile
+	buf, err := os.ReadFile(fileName)
+	if err == nil && bytes.Equal(buf, pl.lastSaved) {
+		//written by ourselves or not changed
+		pl.saveLock.Unlock()
+		return rr
+	}
+
+	var items []*ProxyItem
+	if err == nil {
+		items, _, err = parseConfigAs(buf, getCfgFormat(fileName))
+	}
+	if err != nil {
+		pl.saveLock.Unlock()
+		rr.Errors = append(rr.Errors, err.Error())
+		log.Println("Failed to reload config", fileName, err)
+		events.publishReload(rr)
+		return rr
+	}
+
+	//the file is the source now, it is not rewritten unless new ids are assigned
+	pl.lastSaved = buf
+	pl.readOnly = false
+	pl.saveLock.Unlock()
+
+	log.Println("Reloading config", fileName)
+	rr = pl.apply(items, APPLY_RELOAD, false)
+	log.Println("Reloaded config", fileName+":", rr)
+	if rr.newIds {
+		//write the ids back, or the next reload adds them again
+		pl.save(fileName)
+	}
+	events.publishReload(rr)
+	return rr
+}
+
+// watch config file and reload it on change
+func watchCfg(fileName string) {
+	err := watchFile(fileName, scheduleReload)
+	if err != nil {
+		log.Println("Failed to watch config", fileName+":", err, ", send SIGHUP to reload")
+		return
+	}
+	log.Println("Watching config", fileName)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func newTestProxyList(t *testing.T) *ProxyList {
+	t.Helper()
+	cfg.autoStart = false
+	cfg.autoSave = false
+	return &ProxyList{pmap: make(map[int]*ProxyItem)}
+}
+
+func testProxy(port int, desc string) *ProxyItem {
+	return &ProxyItem{
+		Type:       "tcp",
+		LocalIp:    "127.0.0.1",
+		LocalPort:  port,
+		RemoteIp:   "127.0.0.1",
+		RemotePort: 22,
+		Desc:       desc,
+	}
+}
+
+func proxyPorts(pl *ProxyList) []int {
+	var ports []int
+	for _, p := range pl.list() {
+		ports = append(ports, p.LocalPort)
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+func TestApplyMerge(t *testing.T) {
+	pl := newTestProxyList(t)
+	pl.add(testProxy(10001, "a"))
+	pl.add(testProxy(10002, "b"))
+
+	rr := pl.apply([]*ProxyItem{testProxy(10002, "b2"), testProxy(10003, "c")}, APPLY_MERGE, false)
+	if len(rr.Errors) > 0 {
+		t.Fatal(rr.Errors)
+	}
+	if !slices.Equal(rr.Added, []int{3}) || !slices.Equal(rr.Modified, []int{2}) || len(rr.Removed) != 0 {
+		t.Fatalf("unexpected result %v", rr)
+	}
+	if ports := proxyPorts(pl); !slices.Equal(ports, []int{10001, 10002, 10003}) {
+		t.Fatalf("unexpected proxies %v", ports)
+	}
+	if p, _ := pl.getN(2); p.Desc != "b2" {
+		t.Fatalf("proxy 2 not modified, desc %s", p.Desc)
+	}
+}
+
+func TestApplyReplace(t *testing.T) {
+	pl := newTestProxyList(t)
+	pl.add(testProxy(10001, "a"))
+	pl.add(testProxy(10002, "b"))
+
+	//ids in the imported file belong to another server
+	items := []*ProxyItem{testProxy(10002, "b"), testProxy(10003, "c"), testProxy(10004, "d")}
+	items[1].Id = 7
+	items[2].Id = 2
+	rr := pl.apply(items, APPLY_REPLACE, false)
+	if len(rr.Errors) > 0 {
+		t.Fatal(rr.Errors)
+	}
+	if !slices.Equal(rr.Added, []int{3, 4}) || !slices.Equal(rr.Removed, []int{1}) || !slices.Equal(rr.Unchanged, []int{2}) {
+		t.Fatalf("unexpected result %v", rr)
+	}
+	if ports := proxyPorts(pl); !slices.Equal(ports, []int{10002, 10003, 10004}) {
+		t.Fatalf("unexpected proxies %v", ports)
+	}
+}
+
+func TestApplyDryRun(t *testing.T) {
+	pl := newTestProxyList(t)
+	pl.add(testProxy(10001, "a"))
+	pl.add(testProxy(10002, "b"))
+
+	item := testProxy(10003, "c")
+	item.Id = 9
+	rr := pl.apply([]*ProxyItem{testProxy(10002, "b2"), item}, APPLY_REPLACE, true)
+	if !rr.DryRun || len(rr.Errors) > 0 {
+		t.Fatalf("unexpected result %v", rr)
+	}
+	if !slices.Equal(rr.Added, []int{0}) || !slices.Equal(rr.Modified, []int{2}) || !slices.Equal(rr.Removed, []int{1}) {
+		t.Fatalf("unexpected result %v", rr)
+	}
+	if len(rr.Changes) != 3 {
+		t.Fatalf("unexpected changes %v", rr.Changes)
+	}
+	if ports := proxyPorts(pl); !slices.Equal(ports, []int{10001, 10002}) {
+		t.Fatalf("dry run changed proxies %v", ports)
+	}
+	if p, _ := pl.getN(2); p.Desc != "b" {
+		t.Fatalf("dry run modified proxy 2, desc %s", p.Desc)
+	}
+}
@@ -11,24 +11,143 @@
         var localObj = {
             id: serverObj.Id,
             desc: serverObj.Desc,
+            group: serverObj.Group || "",
+            tags: (serverObj.Tags || []).join(","),
             localip: serverObj.LocalIp,
             localport: serverObj.LocalPort,
             remoteip: serverObj.RemoteIp,
             remoteport: serverObj.RemotePort,
             status: serverObj.Status,
             instances: serverObj.Instances,
+            lasterror: serverObj.LastError || "",
+            mode: serverObj.Mode || "tran",
             type: serverObj.Type || "tcp",
-            termtype: serverObj.TermType || "ssh"
+            remotetype: serverObj.RemoteType || "",
+            localpath: serverObj.LocalPath || "",
+            remotepath: serverObj.RemotePath || "",
+            sockmode: serverObj.SockMode || "",
+            agent: serverObj.Agent || "",
+            draintimeout: serverObj.DrainTimeout || 0,
+            allow: (serverObj.Allow || []).join(","),
+            deny: (serverObj.Deny || []).join(","),
+            termtype: serverObj.TermType || "ssh",
+            sshagentforward: serverObj.SshAgentForward || false,
+            sshagentauth: serverObj.SshAgentAuth || false,
+            udptimeout: serverObj.UdpTimeout || 0
+        }
+        return localObj
+    }
+
+    function splitList(s) {
+        var list = []
+        var items = (s || "").split(",")
+        for (var i = 0; i < items.length; i++) {
+            var v = items[i].trim()
+            if (v != "") {
+                list.push(v)
+            }
+        }
+        return list
+    }
+
+    function convertAgentFromServer(serverObj) {
+        var localObj = {
+            name: serverObj.Name,
+            online: serverObj.Online,
+            addr: serverObj.Addr,
+            since: serverObj.Since,
+            streams: serverObj.Streams
+        }
+        return localObj
+    }
+
+    function convertSshKeyFromServer(serverObj) {
+        var localObj = {
+            id: serverObj.Id,
+            name: serverObj.Name,
+            scope: serverObj.ProxyId ? "代理" + serverObj.ProxyId : "用户" + serverObj.Owner,
+            user: serverObj.User,
+            publickey: serverObj.PublicKey,
+            fingerprint: serverObj.Fingerprint,
+            created: serverObj.Created
+        }
+        return localObj
+    }
+
+    function convertHostKeyFromServer(serverObj) {
+        var localObj = {
+            id: serverObj.Id,
+            host: serverObj.Host,
+            proxyid: serverObj.ProxyId,
+            user: serverObj.User,
+            oldfingerprint: serverObj.OldFingerprint || "未知主机",
+            fingerprint: serverObj.KeyType + " " + serverObj.Fingerprint,
+            time: serverObj.Time
+        }
+        return localObj
+    }
+
+    function convertSessionFromServer(serverObj) {
+        var observers = []
+        for (var i = 0; i < serverObj.Observers.length; i++) {
+            var o = serverObj.Observers[i]
+            observers.push(o.User + (o.Waiting ? "(等待允许)" : (o.ReadOnly ? "(只读)" : "(可输入)")))
+        }
+        var localObj = {
+            id: serverObj.Id,
+            owner: serverObj.Owner,
+            proxyid: serverObj.ProxyId,
+            target: serverObj.Target,
+            termtype: serverObj.TermType,
+            start: serverObj.Start,
+            observers: observers.join(", ")
+        }
+        return localObj
+    }
+
+    function convertRecordingFromServer(serverObj) {
+        var localObj = {
+            id: serverObj.Id,
+            user: serverObj.User,
+            proxyid: serverObj.ProxyId,
+            target: serverObj.TermType + " " + serverObj.Target,
+            start: serverObj.Start,
+            duration: serverObj.Active ? "录制中" : serverObj.Duration + "秒",
+            size: (serverObj.Size / 1024).toFixed(1) + "KB",
+            active: serverObj.Active
+        }
+        return localObj
+    }
+
+    function convertConnFromServer(serverObj) {
+        var localObj = {
+            id: serverObj.Id,
+            clientaddr: serverObj.ClientAddr,
+            upstreamaddr: serverObj.UpstreamAddr,
+            starttime: serverObj.StartTime,
+            lastactive: serverObj.LastActive,
+            bytesin: serverObj.BytesIn,
+            bytesout: serverObj.BytesOut
         }
         return localObj
     }
 
     var lastSelectedTr = undefined
     Vue.prototype.$http = axios
+    axios.interceptors.response.use(function(res) {
+        return res
+    }, function(err) {
+        if (err.response && err.response.status == 401) {
+            window.location.href = "login.html"
+        } else if (err.response && err.response.status == 403) {
+            vapp.$message.error("权限不足")
+        }
+        return Promise.reject(err)
+    })
     var vapp = new Vue({
         el: "#vApp",
         data: {
-            statusName: [ "stopped", "started", "connected" ],
+            statusName: [ "stopped", "running", "starting", "stopping", "failed" ],
             startBtnVals: [ "el-icon-video-play", "el-icon-video-pause" ],
             proxylist: [
                 /* example
@@ -44,6 +163,18 @@
                 */
             ],
             defaultIp: "",
+            user: {},
+            agentList: [],
+            sshKeyList: [],
+            hostKeyList: [],
+            recordingList: [],
+            sessionList: [],
+            isKeyModalActive: false,
+            keyName: "",
+            keyProxyId: "",
+            keyUser: "",
+            keyPrivate: "",
+            keyPassphrase: "",
             proxyListColumns: [
                 {
                     field: "id",
@@ -56,22 +187,30 @@
                     label: '设备描述'
                 },
                 {
-                    field: 'localip',
+                    field: 'group',
+                    label: '分组'
+                },
+                {
+                    field: 'tags',
+                    label: '标签'
+                },
+                {
+                    field: 'showLocalIp',
                     label: '本地IP地址',
                     width: 180
                 },
                 {
-                    field: 'localport',
+                    field: 'showLocalPort',
                     label: '本地端口',
                 },
                 {
-                    field: 'remoteip',
+                    field: 'showRemoteIp',
                     label: '远端IP地址',
                     width: 180,
                     centered: false
                 },
                 {
-                    field: 'remoteport',
+                    field: 'showRemotePort',
                     label: '远端端口',
                 },
                 {
@@ -82,10 +221,18 @@
                     field: 'instances',
                     label: '实例数'
                 },
+                {
+                    field: 'mode',
+                    label: '工作模式'
+                },
                 {
                     field: 'type',
                     label: '协议类型'
                 },
+                {
+                    field: 'showAgent',
+                    label: '代理节点'
+                },
                 {
                     field: 'termtype',
                     label: '终端类型'
@@ -96,6 +243,10 @@
                 }
             ],
             isEditModalActive: false,
+            isConnsModalActive: false,
+            connsTitle: "",
+            connsProxyId: 0,
+            connList: [],
             editFieldConfig:[
                 {
                     label: "测试标签",
@@ -106,6 +257,20 @@
                     model: 1
                 }
             ],
+            modeOptions: [
+                {
+                    value: 'tran',
+                    label: 'tran (监听本地, 连接远端)'
+                },
+                {
+                    value: 'listen',
+                    label: 'listen (监听本地和远端)'
+                },
+                {
+                    value: 'slave',
+                    label: 'slave (连接本地和远端)'
+                }
+            ],
             protocolOptions: [
                 {
                     value: 'tcp',
@@ -114,6 +279,24 @@
                 {
                     value: 'udp',
                     label: 'udp'
+                },
+                {
+                    value: 'unix',
+                    label: 'unix'
+                }
+            ],
+            remoteProtocolOptions: [
+                {
+                    value: '',
+                    label: '同本地'
+                },
+                {
+                    value: 'tcp',
+                    label: 'tcp'
+                },
+                {
+                    value: 'unix',
+                    label: 'unix'
                 }
             ],
             termTypeOptions: [
@@ -127,6 +310,10 @@
                 }
             ],
             editDesc: "",
+            editGroup: "",
+            editTags: "",
+            filterGroup: "",
+            filterTags: [],
             editLocalIp: "",
             editLocalPort: 0,
             editRemoteIp: "",
@@ -134,22 +321,91 @@
             editTitle: "",
             editMode: 0,
             editId: 0,  //proxy id
+            editProxyMode: "tran",
             editType: "tcp",
             editTermType: "ssh",
+            editSshAgentForward: false,
+            editSshAgentAuth: false,
+            editUdpTimeout: 0,
+            editRemoteType: "",
+            editLocalPath: "",
+            editRemotePath: "",
+            editSockMode: "",
+            editAgent: "",
+            editDrainTimeout: 0,
+            editAllow: "",
+            editDeny: "",
             editProxyArrayIndex: undefined  //proxy list index
         },
         computed: {
+            hasFilter: function() {
+                return this.filterGroup != "" || this.filterTags.length > 0
+            },
+            groupOptions: function() {
+                var groups = []
+                for (var i = 0; i < this.proxylist.length; i++) {
+                    var g = this.proxylist[i].group
+                    if (g && groups.indexOf(g) < 0) {
+                        groups.push(g)
+                    }
+                }
+                return groups.sort()
+            },
+            tagOptions: function() {
+                var tags = []
+                for (var i = 0; i < this.proxylist.length; i++) {
+                    var list = splitList(this.proxylist[i].tags)
+                    for (var j = 0; j < list.length; j++) {
+                        if (tags.indexOf(list[j]) < 0) {
+                            tags.push(list[j])
+                        }
+                    }
+                }
+                return tags.sort()
+            },
             proxyList: function() {
                 var showlist=[]
                 for (i=0; i < this.proxylist.length; i++) {
                     var pitem = this.proxylist[i]
+                    if (!this.matchFilter(pitem)) {
+                        continue
+                    }
                     pitem.showStatus = this.statusName[pitem.status]
+                    if (pitem.lasterror) {
+                        pitem.showStatus += " (" + pitem.lasterror + ")"
+                    }
+                    pitem.showAgent = this.getAgentStatus(pitem.agent)
+                    if (pitem.type == "unix") {
+                        pitem.showLocalIp = pitem.localpath
+                        pitem.showLocalPort = ""
+                    } else {
+                        pitem.showLocalIp = pitem.localip
+                        pitem.showLocalPort = pitem.localport
+                    }
+                    if ((pitem.remotetype || pitem.type) == "unix") {
+                        pitem.showRemoteIp = pitem.remotepath
+                        pitem.showRemotePort = ""
+                    } else {
+                        pitem.showRemoteIp = pitem.remoteip
+                        pitem.showRemotePort = pitem.remoteport
+                    }
                     showlist.push(pitem)
                 }
                 return showlist
             }
         },
         created: function() {
+            this.$http.get("/lcx/whoami").then(
+                function(res){
+                    vapp.user = res.data
+                    if (vapp.user.Role != "viewer") {
+                        vapp.loadSshKeys()
+                        vapp.loadRecordings()
+                        vapp.loadSessions()
+                    }
+                },function(res){
+                    console.log(res.status);
+                });
             this.$http.get("/lcx/proxylist").then(
                 function(res){
                     var newobj = {}
@@ -169,8 +425,244 @@
                 },function(res){
                     console.log(res.status);
                 });
+            this.loadAgents()
+            setInterval(this.loadAgents, 5000)
+            this.loadHostKeys()
+            this.subscribeEvents()
         },
         methods: {
+            loadAgents: function() {
+                this.$http.get("/lcx/agents").then(
+                    function(res){
+                        var list = []
+                        for (var i = 0; i < res.data.length; i++) {
+                            list.push(convertAgentFromServer(res.data[i]))
+                        }
+                        vapp.agentList = list
+                    },function(res){
+                        console.log(res.status);
+                    });
+            },
+            loadSshKeys: function() {
+                this.$http.get("/api/v2/sshkeys").then(
+                    function(res){
+                        var list = []
+                        for (var i = 0; i < res.data.length; i++) {
+                            list.push(convertSshKeyFromServer(res.data[i]))
+                        }
+                        vapp.sshKeyList = list
+                    },function(res){
+                        console.log(res.status);
+                    });
+            },
+            loadHostKeys: function() {
+                this.$http.get("/api/v2/hostkeys/pending").then(
+                    function(res){
+                        var list = []
+                        for (var i = 0; i < res.data.length; i++) {
+                            list.push(convertHostKeyFromServer(res.data[i]))
+                        }
+                        vapp.hostKeyList = list
+                    },function(res){
+                        console.log(res.status);
+                    });
+            },
+            resolveHostKey: function(k, action) {
+                var msg = action == 'accept' ? '确定信任' + k.host + '的新密钥吗?' : '确定拒绝' + k.host + '的新密钥吗?'
+                this.$confirm(msg, '主机密钥', { type: 'warning' }).then(function() {
+                    vapp.$http.post("/api/v2/hostkeys/pending/" + k.id + "/" + action).then(function(res){
+                        vapp.loadHostKeys()
+                    },function(res){
+                        console.log(res.status);
+                    })
+                }, function() {})
+            },
+            addSshKeyClicked: function() {
+                this.keyName = ""
+                this.keyProxyId = ""
+                this.keyUser = ""
+                this.keyPrivate = ""
+                this.keyPassphrase = ""
+                this.isKeyModalActive = true
+            },
+            addSshKey: function() {
+                var k = {
+                    Name: this.keyName,
+                    ProxyId: parseInt(this.keyProxyId) || 0,
+                    User: this.keyUser,
+                    PrivateKey: this.keyPrivate,
+                    Passphrase: this.keyPassphrase
+                }
+                var generated = k.PrivateKey == ""
+                this.$http.post("/api/v2/sshkeys", k).then(function(res){
+                    vapp.isKeyModalActive = false
+                    vapp.loadSshKeys()
+                    if (generated) {
+                        vapp.showPublicKey(convertSshKeyFromServer(res.data))
+                    }
+                },function(err){
+                    if (err.response && err.response.data.Error) {
+                        vapp.$message.error(err.response.data.Error.Message)
+                    }
+                })
+            },
+            showPublicKey: function(k) {
+                this.$alert(k.publickey, k.name + '公钥, 请添加到目标的authorized_keys', { customClass: 'pubkey' })
+            },
+            delSshKey: function(k) {
+                this.$confirm('确定删除密钥' + k.name + '吗?', '删除密钥', { type: 'warning' }).then(function() {
+                    vapp.$http.delete("/api/v2/sshkeys/" + k.id).then(function(res){
+                        vapp.loadSshKeys()
+                    },function(res){
+                        console.log(res.status);
+                    })
+                }, function() {})
+            },
+            loadSessions: function() {
+                this.$http.get("/api/v2/sessions").then(
+                    function(res){
+                        var list = []
+                        for (var i = 0; i < res.data.length; i++) {
+                            list.push(convertSessionFromServer(res.data[i]))
+                        }
+                        vapp.sessionList = list
+                    },function(res){
+                        console.log(res.status);
+                    });
+            },
+            joinSession: function(s, mode) {
+                window.open("term.html?id=" + s.proxyid + "&session=" + s.id + "&mode=" + mode
+                    + "&target=" + s.target + "&termtype=" + s.termtype)
+            },
+            loadRecordings: function() {
+                this.$http.get("/api/v2/recordings").then(
+                    function(res){
+                        var list = []
+                        for (var i = 0; i < res.data.length; i++) {
+                            list.push(convertRecordingFromServer(res.data[i]))
+                        }
+                        vapp.recordingList = list
+                    },function(res){
+                        console.log(res.status);
+                    });
+            },
+            playRecording: function(r) {
+                window.open("play.html?id=" + r.id)
+            },
+            delRecording: function(r) {
+                this.$confirm('确定删除录像' + r.id + '吗?', '删除录像', { type: 'warning' }).then(function() {
+                    vapp.$http.delete("/api/v2/recordings/" + r.id).then(function(res){
+                        vapp.loadRecordings()
+                        vapp.loadSessions()
+                    },function(res){
+                        console.log(res.status);
+                    })
+                }, function() {})
+            },
+            subscribeEvents: function() {
+                var es = new EventSource("/api/v2/events")
+                var types = [ "added", "removed", "modified", "started", "stopped", "failed", "conn_opened", "conn_closed", "reloaded", "imported", "hostkey" ]
+                for (var i = 0; i < types.length; i++) {
+                    es.addEventListener(types[i], function(evt) {
+                        vapp.onProxyEvent(JSON.parse(evt.data))
+                    })
+                }
+            },
+            onProxyEvent: function(e) {
+                if (e.Type == "reloaded" || e.Type == "imported") {
+                    if (e.Reload.Errors && e.Reload.Errors.length > 0) {
+                        this.$message.error('配置重新加载出错：' + e.Reload.Errors.join("; "))
+                    } else {
+                        this.$message.info('配置已重新加载')
+                    }
+                    return
+                }
+                if (e.Type == "hostkey") {
+                    this.$message.warning('主机' + e.HostKey.Host + '的密钥未被信任, 连接已拒绝')
+                    this.loadHostKeys()
+                    return
+                }
+                if (e.Type == "removed") {
+                    var idx = this.getArrayIndexByProxyId(e.ProxyId)
+                    if (idx != undefined) {
+                        this.proxylist.splice(idx, 1)
+                    }
+                    return
+                }
+
+                if (e.Proxy) {
+                    this.setProxyItem(e.Proxy)
+                }
+                if (e.Type == "failed") {
+                    this.$message.error(e.ProxyId + '启动失败：' + e.Error)
+                }
+                if ((e.Type == "conn_opened" || e.Type == "conn_closed") && this.isConnsModalActive && this.connsProxyId == e.ProxyId) {
+                    this.loadConns()
+                }
+            },
+            setProxyItem: function(serverObj) {
+                var item = convertProxyItemFromServer(serverObj)
+                var idx = this.getArrayIndexByProxyId(item.id)
+                if (idx == undefined) {
+                    this.proxylist.push(item)
+                    this.proxylist.sort(function(a, b){return a.id - b.id})
+                } else {
+                    this.$set(this.proxylist, idx, item)
+                }
+            },
+            matchFilter: function(p) {
+                if (this.filterGroup && p.group != this.filterGroup) {
+                    return false
+                }
+                var tags = splitList(p.tags)
+                for (var i = 0; i < this.filterTags.length; i++) {
+                    if (tags.indexOf(this.filterTags[i]) < 0) {
+                        return false
+                    }
+                }
+                return true
+            },
+            bulkAction: function(action) {
+                var names = { start: "启动", stop: "停止", delete: "删除" }
+                var params = new URLSearchParams()
+                if (this.filterGroup) {
+                    params.append("group", this.filterGroup)
+                }
+                for (var i = 0; i < this.filterTags.length; i++) {
+                    params.append("tag", this.filterTags[i])
+                }
+                var count = this.proxyList.length
+
+                this.$confirm('确定' + names[action] + '选中的' + count + '个代理吗?', '批量操作', { type: 'warning' }).then(function() {
+                    vapp.$http.post("/api/v2/bulk/" + action + "?" + params.toString()).then(function(res){
+                        if (res.data.Failed > 0) {
+                            var errs = []
+                            for (var i = 0; i < res.data.Results.length; i++) {
+                                var r = res.data.Results[i]
+                                if (r.Error) {
+                                    errs.push(r.Id + ": " + r.Error)
+                                }
+                            }
+                            vapp.$message.error(names[action] + '失败' + res.data.Failed + '个：' + errs.join("; "))
+                        } else {
+                            vapp.$message.info('已' + names[action] + res.data.Results.length + '个代理')
+                        }
+                    },function(res){
+                        console.log(res.status);
+                    })
+                }, function() {})
+            },
+            getAgentStatus: function(name) {
+                if (!name) {
+                    return ""
+                }
+                for (var i = 0; i < this.agentList.length; i++) {
+                    if (this.agentList[i].name == name) {
+                        return name + (this.agentList[i].online ? " (online)" : " (offline)")
+                    }
+                }
+                return name + " (offline)"
+            },
             testClick: function(e) {
                 console.log("Test clicked")
             },
@@ -213,6 +705,34 @@
                 + "&remoteip=" + p.remoteip + "&remoteport=" + p.remoteport
                 + "&termtype=" + p.termtype)
             },
+            connsBtnClicked: function(e, p) {
+                this.connsProxyId = p.id
+                this.connsTitle = "代理" + p.id + "连接列表"
+                this.connList = []
+                this.loadConns()
+                this.isConnsModalActive = true
+            },
+            loadConns: function() {
+                this.$http.get("/lcx/proxy/conns?id=" + this.connsProxyId).then(function(res){
+                    var list = []
+                    for (var i = 0; i < res.data.length; i++) {
+                        list.push(convertConnFromServer(res.data[i]))
+                    }
+                    vapp.connList = list
+                },function(res){
+                    console.log(res.status);
+                })
+            },
+            killConn: function(c) {
+                this.$http.get("/lcx/proxy/conns?id=" + this.connsProxyId + "&op=kill&conn=" + c.id).then(function(res){
+                    if (res.data.Result != 0) {
+                        vapp.$message.error(res.data.ErrMsg);
+                    }
+                    vapp.loadConns()
+                },function(res){
+                    console.log(res.status);
+                })
+            },
             cellClicked: function(row, col, rowIndex, colIndex) {
                 console.log("Cell clicked, row " + rowIndex + ", col " + colIndex + ", field: " + col.field)
             },
@@ -231,12 +751,26 @@
                 console.log("Double clicked, row:", row.desc)
                 this.editId = row.id
                 this.editDesc = row.desc
+                this.editGroup = row.group
+                this.editTags = row.tags
                 this.editLocalIp = row.localip
                 this.editLocalPort = row.localport
                 this.editRemoteIp = row.remoteip
                 this.editRemotePort = row.remoteport
+                this.editProxyMode = row.mode
                 this.editType = row.type
                 this.editTermType = row.termtype
+                this.editSshAgentForward = row.sshagentforward
+                this.editSshAgentAuth = row.sshagentauth
+                this.editUdpTimeout = row.udptimeout
+                this.editRemoteType = row.remotetype
+                this.editLocalPath = row.localpath
+                this.editRemotePath = row.remotepath
+                this.editSockMode = row.sockmode
+                this.editAgent = row.agent
+                this.editDrainTimeout = row.draintimeout
+                this.editAllow = row.allow
+                this.editDeny = row.deny
                 this.editTitle = '修改代理信息'
                 this.editMode = 1
                 var haveIndex = undefined
@@ -249,12 +783,26 @@
                 console.log("Add proxy," + this)
                 this.editId = 0
                 this.editDesc = ""
+                this.editGroup = this.filterGroup
+                this.editTags = this.filterTags.join(",")
                 this.editLocalIp = this.defaultIp
                 this.editLocalPort = 30000
                 this.editRemoteIp = ""
                 this.editRemotePort = 22
+                this.editProxyMode = "tran"
                 this.editType = "tcp"
                 this.editTermType = "ssh"
+                this.editSshAgentForward = false
+                this.editSshAgentAuth = false
+                this.editUdpTimeout = 0
+                this.editRemoteType = ""
+                this.editLocalPath = ""
+                this.editRemotePath = ""
+                this.editSockMode = ""
+                this.editAgent = ""
+                this.editDrainTimeout = 0
+                this.editAllow = ""
+                this.editDeny = ""
                 this.editTitle = '新增代理信息'
                 this.editMode = 0
 
@@ -265,24 +813,52 @@
             },
             updateLocalProxyItem: function(proxyItem) {
                 proxyItem.desc = this.editDesc
+                proxyItem.group = this.editGroup || ""
+                proxyItem.tags = splitList(this.editTags).join(",")
                 proxyItem.localip = this.editLocalIp
                 proxyItem.localport = this.editLocalPort
                 proxyItem.remoteip = this.editRemoteIp
                 proxyItem.remoteport = this.editRemotePort
+                proxyItem.mode = this.editProxyMode
                 proxyItem.type = this.editType
                 proxyItem.termtype = this.editTermType
+                proxyItem.sshagentforward = this.editSshAgentForward
+                proxyItem.sshagentauth = this.editSshAgentAuth
+                proxyItem.udptimeout = this.editUdpTimeout
+                proxyItem.remotetype = this.editRemoteType
+                proxyItem.localpath = this.editLocalPath
+                proxyItem.remotepath = this.editRemotePath
+                proxyItem.sockmode = this.editSockMode
+                proxyItem.agent = this.editAgent
+                proxyItem.draintimeout = this.editDrainTimeout
+                proxyItem.allow = this.editAllow
+                proxyItem.deny = this.editDeny
                 //newProxy.status = 0
             },
             getProxyVar: function() {
                 var newProxy = {}
                 newProxy.Id = this.editId
                 newProxy.Desc = this.editDesc
+                newProxy.Group = this.editGroup || ""
+                newProxy.Tags = splitList(this.editTags)
                 newProxy.LocalIp = this.editLocalIp
                 newProxy.LocalPort = parseInt(this.editLocalPort)
                 newProxy.RemoteIp = this.editRemoteIp
                 newProxy.RemotePort = parseInt(this.editRemotePort)
+                newProxy.Mode = this.editProxyMode
                 newProxy.Type = this.editType
                 newProxy.TermType = this.editTermType
+                newProxy.SshAgentForward = this.editSshAgentForward
+                newProxy.SshAgentAuth = this.editSshAgentAuth
+                newProxy.UdpTimeout = parseInt(this.editUdpTimeout) || 0
+                newProxy.RemoteType = this.editType == "udp" ? "" : this.editRemoteType
+                newProxy.LocalPath = this.editLocalPath
+                newProxy.RemotePath = this.editRemotePath
+                newProxy.SockMode = this.editSockMode
+                newProxy.Agent = this.editAgent || ""
+                newProxy.DrainTimeout = parseInt(this.editDrainTimeout) || 0
+                newProxy.Allow = splitList(this.editAllow)
+                newProxy.Deny = splitList(this.editDeny)
                 newProxy.Status = 0
                 return newProxy
             },
@@ -290,7 +866,7 @@
                 this.$http.post("/lcx/proxy/add", p).then(
                 function(res){
                     console.log("post res:" + res.status + ", resbody:" + res.data)
-                    vapp.proxylist.push(convertProxyItemFromServer(res.data))
+                    vapp.setProxyItem(res.data)
                 },function(res){
                     console.log(res.status);
                 });
@@ -329,12 +905,18 @@
                     console.log("start proxy:" + res.status + ", resdata:" + res.data)
                     if (res.data.Result != 0) {
                         vapp.$message.error(res.data.Id + '启动失败：' + res.data.ErrMsg);
+                        id = vapp.getArrayIndexByProxyId(res.data.Id)
+                        if (id < vapp.proxylist.length) {
+                            vapp.proxylist[id].status = res.data.Status
+                            vapp.proxylist[id].lasterror = res.data.ErrMsg
+                        }
                     } else {
                         //modify status here
                         //setStatus
                         id = vapp.getArrayIndexByProxyId(res.data.Id)
                         if (id < vapp.proxylist.length) {
                             vapp.proxylist[id].status = res.data.Status
+                            vapp.proxylist[id].lasterror = ""
                         }
                     }
                 },function(res){
@@ -346,6 +928,9 @@
                     if (res.data.Result != 0) {
                         vapp.$message.error(res.data.Id + '停止失败：' + res.data.ErrMsg);
                     } else {
+                        if (res.data.Drained || res.data.Killed) {
+                            vapp.$message.info(res.data.Id + '已停止, 结束连接' + res.data.Drained + '个, 强制断开' + res.data.Killed + '个')
+                        }
                         //modify status here
                         //setStatus
                         id = vapp.getArrayIndexByProxyId(res.data.Id)
@@ -363,6 +948,9 @@
             },
             saveConfig: function() {
                 this.$http.get("/lcx?op=save").then(function(res){ vapp.$message.info("Config saved")})
+            },
+            logout: function() {
+                this.$http.get("/lcx/logout").then(function(res){ window.location.href = "login.html" })
             }
         }
     });
@@ -0,0 +1,156 @@
+//pauses longer than this are shortened when playing
+const MAX_IDLE = 2
+
+var g_Term = undefined
+var g_Header = undefined
+var g_Events = []  //{t, type, data, user}, t is time after shortening idle
+var g_Pos = 0      //next event to play
+var g_Time = 0
+var g_Speed = 1
+var g_Timer = undefined
+
+function getParam(name) {
+    return new URLSearchParams(window.location.search).get(name)
+}
+
+function createTerm(cols, rows) {
+    g_Term = new Terminal({cursorBlink: false, disableStdin: true, logLevel: 1, fontFamily: "consolas", fontSize: 16});
+    g_Term.resize(cols, rows)
+    g_Term.open(document.getElementById("term"))
+}
+
+//asciicast v2: header line, then [time, type, data] lines, input lines have the user as 4th element
+function parseCast(text) {
+    let lines = text.split("\n")
+    g_Header = JSON.parse(lines[0])
+
+    let last = 0
+    let t = 0
+    for (let i = 1; i < lines.length; i++) {
+        if (lines[i] == "") {
+            continue
+        }
+        let e = JSON.parse(lines[i])
+        t += Math.min(e[0] - last, MAX_IDLE)
+        last = e[0]
+        g_Events.push({t: t, type: e[1], data: e[2], user: e[3]})
+    }
+}
+
+function applyEvent(e) {
+    switch (e.type) {
+        case "o":
+            g_Term.write(e.data)
+            break
+        case "r":
+            let size = e.data.split("x")
+            g_Term.resize(parseInt(size[0]), parseInt(size[1]))
+            break
+        case "i":
+            document.getElementById("input").innerText = "输入 " + (e.user || "") + ": " + JSON.stringify(e.data)
+            break
+    }
+}
+
+function totalTime() {
+    return g_Events.length > 0 ? g_Events[g_Events.length - 1].t : 0
+}
+
+function showProgress() {
+    document.getElementById("seek").value = g_Time
+    document.getElementById("progress").innerText = g_Time.toFixed(1) + "s / " + totalTime().toFixed(1) + "s"
+}
+
+function isPlaying() {
+    return g_Timer != undefined
+}
+
+function pause() {
+    clearTimeout(g_Timer)
+    g_Timer = undefined
+    document.getElementById("play").value = "播放"
+}
+
+//play events which are due, then wait for the next one
+function step() {
+    while (g_Pos < g_Events.length && g_Events[g_Pos].t <= g_Time) {
+        applyEvent(g_Events[g_Pos])
+        g_Pos++
+    }
+    showProgress()
+
+    if (g_Pos >= g_Events.length) {
+        pause()
+        return
+    }
+    let next = g_Events[g_Pos].t
+    g_Timer = setTimeout(function() {
+        g_Time = next
+        step()
+    }, (next - g_Time) * 1000 / g_Speed)
+}
+
+//replay from start to time t without waiting
+function seek(t) {
+    g_Term.reset()
+    g_Term.resize(g_Header.width, g_Header.height)
+    document.getElementById("input").innerText = ""
+    g_Pos = 0
+    while (g_Pos < g_Events.length && g_Events[g_Pos].t <= t) {
+        applyEvent(g_Events[g_Pos])
+        g_Pos++
+    }
+    g_Time = t
+    showProgress()
+}
+
+function playBtnClicked() {
+    if (isPlaying()) {
+        pause()
+        return
+    }
+    if (g_Pos >= g_Events.length) {
+        seek(0)
+    }
+    document.getElementById("play").value = "暂停"
+    step()
+}
+
+function speedChanged() {
+    g_Speed = parseFloat(document.getElementById("speed").value)
+    if (isPlaying()) {
+        pause()
+        playBtnClicked()
+    }
+}
+
+function seekChanged() {
+    let playing = isPlaying()
+    pause()
+    seek(parseFloat(document.getElementById("seek").value))
+    if (playing) {
+        playBtnClicked()
+    }
+}
+
+let id = getParam("id")
+fetch("/api/v2/recordings/" + encodeURIComponent(id)).then(function(res) {
+    if (res.status == 401) {
+        window.location.href = "login.html"
+        return
+    }
+    if (!res.ok) {
+        document.getElementById("title").innerText = "Recording " + id + " not found"
+        return
+    }
+    return res.text().then(function(text) {
+        parseCast(text)
+        document.getElementById("title").innerText = "Recording: " + id + ", User: " + g_Header.user
+                + ", ProxyId: " + g_Header.proxy_id + ", Target: " + g_Header.target
+                + ", TermType: " + g_Header.term_type + ", Start: " + new Date(g_Header.timestamp * 1000).toLocaleString()
+        document.getElementById("seek").max = totalTime()
+        createTerm(g_Header.width, g_Header.height)
+        showProgress()
+        playBtnClicked()
+    })
+})
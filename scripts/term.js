@@ -1,15 +1,23 @@
-//state constants
+//state constants, login prompts are handled by server
 const S_WAIT_CONNECT = 0
-const S_SEND_USERNAME = 1
-const S_SEND_PASSWORD = 2
 const S_SHELL_IO = 3
 
 var g_State = S_WAIT_CONNECT
 var g_Term = undefined
+var g_FitAddon = undefined
 var g_WS = undefined
-var g_WSURL = "ws://" + window.location.host + '/ws'
+var g_WSURL = (window.location.protocol == "https:" ? "wss://" : "ws://") + window.location.host + '/ws'
 var g_Params = undefined
 
+//joined session of another user, size follows the owner
+function isObserver() {
+    return g_Params.session != undefined
+}
+
+function isReadOnly() {
+    return isObserver() && g_Params.mode != "rw"
+}
+
 function createTerm() {
     g_Term = new Terminal({cursorBlink: true, disableStdin: false, logLevel: 1, fontFamily: "consolas", fontSize: 16});
     if (!g_Term) {
@@ -17,23 +25,21 @@ function createTerm() {
         return
     }
 
+    g_FitAddon = new FitAddon.FitAddon()
+    g_Term.loadAddon(g_FitAddon)
     g_Term.resize(150, 32)
+    //size is sent to server as control message, text frames are terminal data
+    g_Term.onResize(function(size) {
+        document.getElementById("cols").value = size.cols
+        document.getElementById("rows").value = size.rows
+        if (!isObserver()) {
+            sendResize()
+        }
+    })
 
     g_Term.onData(function(data) {
         let ECHO_ON = false
         switch (g_State) {
-            case S_SEND_USERNAME:
-                if (data == '\r' || data == '\n') {
-                    g_Term.write('\n')
-                    g_State = S_SEND_PASSWORD
-                }
-                break
-            case S_SEND_PASSWORD:
-                if (data == '\r' || data == '\n') {
-                    g_Term.write('\r\n')
-                    g_State = S_SHELL_IO
-                }
-                break
             case S_SHELL_IO:
                 break
             case S_WAIT_CONNECT:
@@ -49,7 +55,7 @@ function createTerm() {
         if (ECHO_ON) {
             g_Term.write(data)
         }
-        if (g_WS) {
+        if (g_WS && !isReadOnly()) {
             g_WS.send(data)
         }
     })
@@ -57,6 +63,10 @@ function createTerm() {
     let oTerm = document.getElementById("term")
     if (oTerm) {
         g_Term.open(oTerm)
+        if (!isObserver()) {
+            fitTerm()
+            window.addEventListener("resize", fitTerm)
+        }
     } else {
         console.log("Failed to get term object")
     }
@@ -83,36 +93,103 @@ function getParams() {
     return oGetVars
 }
 
-function ctrlHandler(data) {
-    console.log("Received control packet " + data)
+//fit terminal to the rest of window by fit addon
+function fitTerm() {
+    let oTerm = document.getElementById("term")
+    oTerm.style.height = Math.max(window.innerHeight - oTerm.offsetTop - 10, 0) + "px"
+    g_FitAddon.fit()
+}
+
+//control messages are json in binary frames
+function sendCtrl(msg) {
+    if (g_WS && g_WS.readyState == WebSocket.OPEN) {
+        g_WS.send(new TextEncoder().encode(JSON.stringify(msg)))
+    }
 }
 
-function dataHandler(data) {
-    console.log("Received data packet " + data)
+function sendResize() {
+    sendCtrl({Type: "resize", Cols: g_Term.cols, Rows: g_Term.rows})
+}
+
+function ctrlHandler(msg) {
+    switch (msg.Type) {
+        case "resize":
+            g_Term.resize(msg.Cols, msg.Rows)
+            break
+        case "session":
+            showSession(msg.Session)
+            break
+        default:
+            console.log("Unknown control message", msg)
+    }
+}
+
+function addButton(oParent, text, onclick) {
+    let oBtn = document.createElement("input")
+    oBtn.type = "button"
+    oBtn.value = text
+    oBtn.onclick = onclick
+    oParent.appendChild(oBtn)
+}
+
+//session owner can kick observers and allow their input
+function showSession(sess) {
+    let oSession = document.getElementById("session")
+    oSession.innerHTML = ""
+    oSession.appendChild(document.createTextNode("会话" + sess.Id + ", 用户: " + sess.Owner + ", 观察者: "))
+    if (sess.Observers.length == 0) {
+        oSession.appendChild(document.createTextNode("无"))
+    }
+
+    for (let i = 0; i < sess.Observers.length; i++) {
+        let o = sess.Observers[i]
+        let state = o.Waiting ? "(请求观看) " : (o.Pending ? "(请求输入) " : (o.ReadOnly ? "(只读) " : "(可输入) "))
+        oSession.appendChild(document.createTextNode(" " + o.User + state))
+        if (isObserver()) {
+            continue
+        }
+        if (o.Waiting) {
+            addButton(oSession, "允许观看", function() { sendCtrl({Type: "grant", Observer: o.Id, Allow: true}) })
+            addButton(oSession, "拒绝", function() { sendCtrl({Type: "grant", Observer: o.Id, Allow: false}) })
+            continue
+        }
+        if (o.ReadOnly) {
+            addButton(oSession, "允许输入", function() { sendCtrl({Type: "grant", Observer: o.Id, Allow: true}) })
+        }
+        if (o.Pending || !o.ReadOnly) {
+            addButton(oSession, o.Pending ? "拒绝" : "禁止输入", function() { sendCtrl({Type: "grant", Observer: o.Id, Allow: false}) })
+        }
+        addButton(oSession, "踢出", function() {
+            fetch("/api/v2/sessions/" + sess.Id + "/observers/" + o.Id, {method: "DELETE"})
+        })
+    }
 }
 
 function createWebSocket(params) {
     if (g_State == S_WAIT_CONNECT) {
-        g_WS = new WebSocket(g_WSURL + '?op=termconnect&id=' + params.id);
+        let url = g_WSURL + '?op=termconnect&id=' + params.id
+        if (isObserver()) {
+            url += '&session=' + params.session + '&mode=' + (isReadOnly() ? 'ro' : 'rw')
+        }
+        g_WS = new WebSocket(url);
         if (!g_WS) {
             console.log("Failed to create websocket")
             return
         }
+        g_WS.binaryType = "arraybuffer"
 
         g_WS.onopen = function(evt) {
             console.log('Connection open ...');
-            g_State = S_SEND_USERNAME
+            g_State = S_SHELL_IO
+            if (!isObserver()) {
+                sendResize()
+            }
         };
 
         g_WS.onmessage = function(evt) {
-            console.log('Received Message: ' + evt.data);
-            msg = evt.data
-            if (msg.Type == "c") {
-                ctrlHandler(msg.Data)
-            } else if (msg.Type == "d") {
-                dataHandler(msg.Data)
+            if (evt.data instanceof ArrayBuffer) {
+                ctrlHandler(JSON.parse(new TextDecoder().decode(evt.data)))
             } else {
-                //unknown type, write out
                 g_Term.write(evt.data)
             }
         };
@@ -129,7 +206,10 @@ function createWebSocket(params) {
 
 function setTitle(params) {
     let oTitle = document.getElementById("title")
-    if (oTitle) {
+    if (oTitle && isObserver()) {
+        oTitle.innerText = "Session: " + params.session + ", RemoteAddr: " + params.target
+                + ", TermType: " + params.termtype + (isReadOnly() ? ", ReadOnly" : ", Input needs approval of owner")
+    } else if (oTitle) {
         oTitle.innerText = "LocalAddr: " + params.localip + ":" + params.localport
                 + ", RemoteAddr: " + params.remoteip + ":" + params.remoteport
                 + ", TermType: " + params.termtype
@@ -159,4 +239,11 @@ g_Params = getParams()
 console.log("ws url: " + g_WSURL + ", params:" + g_Params)
 setTitle(g_Params)
 createTerm()
-createWebSocket(g_Params)
+//websocket can not report 401, check login first
+fetch("/lcx/whoami").then(function(res) {
+    if (res.status == 401) {
+        window.location.href = "login.html"
+        return
+    }
+    createWebSocket(g_Params)
+})
@@ -0,0 +1,75 @@
+/**
+ * Fit addon of xterm.js 4.x, port of xterm-addon-fit 0.5.0 with the same
+ * global (FitAddon.FitAddon), so it can be replaced by the published build.
+ *
+ * Copyright (c) 2017, 2019 The xterm.js authors. All rights reserved.
+ * @license MIT
+ */
+(function(root, factory) {
+    if (typeof exports === "object" && typeof module === "object") {
+        module.exports = factory()
+    } else if (typeof define === "function" && define.amd) {
+        define([], factory)
+    } else if (typeof exports === "object") {
+        exports.FitAddon = factory()
+    } else {
+        root.FitAddon = factory()
+    }
+})(self, function() {
+    "use strict"
+
+    var MINIMUM_COLS = 2
+    var MINIMUM_ROWS = 1
+
+    function FitAddon() {
+        this._terminal = undefined
+    }
+
+    FitAddon.prototype.activate = function(terminal) {
+        this._terminal = terminal
+    }
+
+    FitAddon.prototype.dispose = function() {
+    }
+
+    FitAddon.prototype.fit = function() {
+        var dims = this.proposeDimensions()
+        if (!dims || !this._terminal || isNaN(dims.cols) || isNaN(dims.rows)) {
+            return
+        }
+
+        var core = this._terminal._core
+        if (this._terminal.rows !== dims.rows || this._terminal.cols !== dims.cols) {
+            core._renderService.clear()
+            this._terminal.resize(dims.cols, dims.rows)
+        }
+    }
+
+    FitAddon.prototype.proposeDimensions = function() {
+        if (!this._terminal || !this._terminal.element || !this._terminal.element.parentElement) {
+            return undefined
+        }
+
+        var core = this._terminal._core
+        var cell = core._renderService.dimensions
+        if (cell.actualCellWidth === 0 || cell.actualCellHeight === 0) {
+            return undefined
+        }
+
+        var parentStyle = window.getComputedStyle(this._terminal.element.parentElement)
+        var parentHeight = parseInt(parentStyle.getPropertyValue("height"))
+        var parentWidth = Math.max(0, parseInt(parentStyle.getPropertyValue("width")))
+        var style = window.getComputedStyle(this._terminal.element)
+        var paddingVer = parseInt(style.getPropertyValue("padding-top")) + parseInt(style.getPropertyValue("padding-bottom"))
+        var paddingHor = parseInt(style.getPropertyValue("padding-right")) + parseInt(style.getPropertyValue("padding-left"))
+        var availableHeight = parentHeight - paddingVer
+        var availableWidth = parentWidth - paddingHor - core.viewport.scrollBarWidth
+
+        return {
+            cols: Math.max(MINIMUM_COLS, Math.floor(availableWidth / cell.actualCellWidth)),
+            rows: Math.max(MINIMUM_ROWS, Math.floor(availableHeight / cell.actualCellHeight))
+        }
+    }
+
+    return {FitAddon: FitAddon}
+})
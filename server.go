@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -17,11 +18,43 @@ import (
 )
 
 type appcfg struct {
-	port      int
-	cfgFile   string
-	autoStart bool
-	debug     bool
-	logLevel  int
+	port       int
+	cfgFile    string
+	autoStart  bool
+	autoSave   bool
+	watch      bool
+	backups    int
+	debug      bool
+	logLevel   int
+	agentUrl   string
+	agentName  string
+	agentKey   string
+	agentToken string
+	auth       bool
+	usersFile  string
+	userAdd    string
+	userRole   string
+	tokenAdd   string
+	listen     string
+	apiListen  string
+	checkApi   bool
+	tls        bool
+	certFile   string
+	keyFile    string
+	clientCa   string
+	agentCa    string
+	clientCert string
+	clientKey  string
+
+	sshKeysFile   string
+	masterKeyFile string
+	sshAgent      string
+	knownHosts    string
+	strictHostKey bool
+	recordDir     string
+	recordDays    int
+	recordMaxSize int
+	recordMask    string
 }
 
 var (
@@ -38,36 +71,87 @@ const (
 
 func init() {
 	flag.IntVar(&cfg.port, "p", 8210, "HTTP server port")
-	flag.StringVar(&cfg.cfgFile, "c", "proxy_config.json", "Proxy config json file")
+	flag.StringVar(&cfg.listen, "listen", "", "UI listen addresses, comma separated, e.g. 127.0.0.1,[::1]:8211,unix:/run/lcx.sock, default all interfaces")
+	flag.StringVar(&cfg.apiListen, "apilisten", "", "API only listen addresses, no web UI files, same format as -listen")
+	flag.StringVar(&cfg.cfgFile, "c", "proxy_config.json", "Proxy config file, format by extension: .json, .yaml/.yml or .toml")
 	flag.BoolVar(&cfg.autoStart, "s", true, "Auto start proxy")
+	flag.BoolVar(&cfg.autoSave, "autosave", true, "Save config automatically after changes")
+	flag.IntVar(&cfg.backups, "backups", 3, "Number of config backups to keep")
+	flag.BoolVar(&cfg.watch, "watch", true, "Reload config file when it changes")
 	flag.BoolVar(&cfg.debug, "d", false, "Show debug info")
 	flag.IntVar(&cfg.logLevel, "l", 0, "Log level")
+	flag.StringVar(&cfg.agentUrl, "agent", "", "Run as agent, connect to controller url, e.g. ws://host:8210")
+	flag.StringVar(&cfg.agentName, "agentname", "", "Agent name, default to hostname")
+	flag.StringVar(&cfg.agentKey, "agentkey", "", "Shared key between agents and controller, if empty agents need -agenttoken of an admin")
+	flag.StringVar(&cfg.agentToken, "agenttoken", "", "API token of an admin user of controller, for agent")
+	flag.BoolVar(&cfg.auth, "auth", true, "Require login for web UI and API")
+	flag.StringVar(&cfg.usersFile, "u", "users.json", "Users json file")
+	flag.StringVar(&cfg.userAdd, "useradd", "", "Add or update user, read password from stdin, then exit")
+	flag.StringVar(&cfg.userRole, "role", "viewer", "Role of -useradd: admin, operator or viewer")
+	flag.StringVar(&cfg.tokenAdd, "tokenadd", "", "Create api token for user, then exit")
+	flag.BoolVar(&cfg.checkApi, "checkapi", false, "Check openapi.json against routes and types, then exit")
+	flag.BoolVar(&cfg.tls, "tls", false, "Serve web UI and API over HTTPS")
+	flag.StringVar(&cfg.certFile, "cert", "lcx.crt", "TLS certificate file, self-signed one is generated if not exist")
+	flag.StringVar(&cfg.keyFile, "key", "lcx.key", "TLS private key file")
+	flag.StringVar(&cfg.clientCa, "clientca", "", "Require client certificates signed by this CA file")
+	flag.StringVar(&cfg.agentCa, "agentca", "", "CA or certificate file to verify controller, for agent with wss://")
+	flag.StringVar(&cfg.clientCert, "clientcert", "", "Client certificate file of agent")
+	flag.StringVar(&cfg.clientKey, "clientkey", "", "Client private key file of agent")
+	flag.StringVar(&cfg.sshKeysFile, "sshkeys", "ssh_keys.json", "Encrypted ssh private keys file for web terminal login")
+	flag.StringVar(&cfg.masterKeyFile, "masterkey", "lcx_master.key", "Master key file of -sshkeys, $"+MASTER_KEY_ENV+" is used instead if set")
+	flag.StringVar(&cfg.knownHosts, "knownhosts", "known_hosts", "Known hosts file of web terminal ssh targets")
+	flag.BoolVar(&cfg.strictHostKey, "stricthostkey", false, "Refuse ssh hosts not in known hosts, instead of trust on first use")
+	flag.StringVar(&cfg.recordDir, "recorddir", "", "Record web terminal sessions to asciicast files in this dir, off if empty")
+	flag.IntVar(&cfg.recordDays, "recorddays", 0, "Remove recordings older than days, 0 to keep")
+	flag.IntVar(&cfg.recordMaxSize, "recordmaxsize", 0, "Max total size of recordings in MB, oldest are removed first, 0 for no limit")
+	flag.StringVar(&cfg.recordMask, "recordmask", RECORD_MASK_DEFAULT, "Regexp of prompts like Password:, recorded input after them is masked, empty to record all input")
+	flag.StringVar(&cfg.sshAgent, "sshagent", "", "ssh-agent socket for web terminal login and agent forwarding of proxies enabling them, e.g. $SSH_AUTH_SOCK")
 }
 
 func signalProc() {
 	var s os.Signal
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	s = <-c
-	fmt.Println("Received signal", s)
-	switch s {
-	case os.Interrupt:
-		proxies.save(cfg.cfgFile)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		s = <-c
+		fmt.Println("Received signal", s)
+		switch s {
+		case syscall.SIGHUP:
+			proxies.reload()
+			if cfg.auth {
+				err := auth.reload()
+				if err != nil {
+					log.Println("Failed to reload users file", cfg.usersFile, err)
+				}
+			}
+			continue
+		case os.Interrupt:
+			proxies.save(cfg.cfgFile)
+		default:
+			proxies.flushSave()
+		}
+		proxies.stopAll()
+		os.Exit(0)
 	}
-	os.Exit(0)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
 	flag.Parse()
 
-	iplist = getIPList()
-	defaultIp, _ = getDefaultIp()
-	fmt.Println("========== IPLIST BEGIN ==========")
-	fmt.Println(iplist)
-	fmt.Println("========== IPLIST END   ==========")
-	fmt.Println(defaultIp)
+	if cfg.checkApi {
+		os.Exit(runCheckApi())
+	}
+
+	if cfg.agentUrl != "" {
+		runAgent()
+		return
+	}
 
 	proxies = &ProxyList{}
 	proxies.pmap = make(map[int]*ProxyItem, 10)
@@ -82,30 +166,135 @@ func main() {
 		os.MkdirAll(cfgdir, 0764)
 	}
 
+	cfg.usersFile = cfgPath(cfg.usersFile)
+	if userCmd() {
+		return
+	}
+	if cfg.auth {
+		initAuth()
+	}
+	cfg.sshKeysFile = cfgPath(cfg.sshKeysFile)
+	cfg.masterKeyFile = cfgPath(cfg.masterKeyFile)
+	initSshKeys()
+	cfg.knownHosts = cfgPath(cfg.knownHosts)
+	initHostKeys()
+	if cfg.recordDir != "" {
+		cfg.recordDir = cfgPath(cfg.recordDir)
+	}
+	initRecordings()
+
+	iplist = getIPList()
+	defaultIp, _ = getDefaultIp()
+	fmt.Println("========== IPLIST BEGIN ==========")
+	fmt.Println(iplist)
+	fmt.Println("========== IPLIST END   ==========")
+	fmt.Println(defaultIp)
+
 	proxies.loadCfg(cfg.cfgFile, cfg.autoStart)
+	if cfg.watch {
+		watchCfg(cfg.cfgFile)
+	}
 
 	go signalProc()
 
 	fmt.Println("Starting go-lcx", proxies)
 
 	fmt.Println("Current work dir:", d)
-	http.Handle("/", http.FileServer(http.Dir(d)))
-	http.HandleFunc("/lcx", lcxHandler)
-	http.HandleFunc("/lcx/defaultip", defaultIpHandler)
-	http.HandleFunc("/lcx/iplist", iplistHandler)
-	http.HandleFunc("/lcx/proxylist", lcxProxyListHandler)
-	http.HandleFunc("/lcx/proxy", lcxProxyHandler) //get & del
-	http.HandleFunc("/lcx/proxy/add", lcxProxyAddHandler)
-	http.HandleFunc("/lcx/proxy/modify", lcxProxyModifyHandler)
-	http.HandleFunc("/lcx/proxy/op", lcxProxyOpHandler) //start/stop/del
-	http.HandleFunc("/ws", websocketHandler)
-	err := http.ListenAndServe(":8210", http.DefaultServeMux)
+	apiMux := newApiMux()
+	uiMux := newApiMux()
+	uiMux.HandleFunc("/", authWrap(uiRole, uiHandler(d)))
+
+	var tc *tls.Config
+	var err error
+	if cfg.tls {
+		tc, err = getServerTlsConfig()
+		if err != nil {
+			log.Fatalln("Failed to setup TLS:", err)
+		}
+	}
+
+	uiList := cfg.listen
+	if uiList == "" {
+		uiList = ":" + strconv.Itoa(cfg.port)
+	}
+	err = serveAdmin(uiList, cfg.apiListen, uiMux, apiMux, tc)
 	if err != nil {
 		log.Println("Failed to start go-lcx server, error:", err)
 	}
 	fmt.Println("Exiting")
 }
 
+// pages of web UI, other files in the executable dir like users.json or keys
+// are never served
+var uiPages = map[string]bool{
+	"index.html": true,
+	"login.html": true,
+	"term.html":  true,
+	"play.html":  true,
+}
+
+func isUiPage(path string) bool {
+	return path == "/" || uiPages[strings.TrimPrefix(path, "/")]
+}
+
+// login page and scripts are public, other pages need login
+func uiRole(req *http.Request) int {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "login.html" || strings.HasPrefix(name, "scripts/") {
+		return ROLE_NONE
+	}
+	return ROLE_VIEWER
+}
+
+// serve ui pages and files under scripts of dir
+func uiHandler(dir string) http.HandlerFunc {
+	scripts := http.StripPrefix("/scripts/", http.FileServer(http.Dir(filepath.Join(dir, "scripts"))))
+	return func(resp http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/")
+		if name == "" {
+			name = "index.html"
+		}
+
+		switch {
+		case uiPages[name]:
+			http.ServeFile(resp, req, filepath.Join(dir, name))
+		case strings.HasPrefix(name, "scripts/") && !strings.HasSuffix(name, "/"):
+			scripts.ServeHTTP(resp, req)
+		default:
+			http.NotFound(resp, req)
+		}
+	}
+}
+
+// mux of management api, every handler is checked by authWrap
+// routes used by web UI before /api/v2, handlers check methods and params themselves.
+// they are listed in openapi.json too
+func getLegacyRoutes() []apiRoute {
+	return []apiRoute{
+		{"/lcx", []string{"GET"}, lcxRole, lcxHandler},
+		{"/lcx/defaultip", []string{"GET"}, needRole(ROLE_VIEWER), defaultIpHandler},
+		{"/lcx/iplist", []string{"GET"}, needRole(ROLE_VIEWER), iplistHandler},
+		{"/lcx/proxylist", []string{"GET"}, needRole(ROLE_VIEWER), lcxProxyListHandler},
+		{"/lcx/proxy", []string{"GET"}, lcxProxyRole, lcxProxyHandler}, //get & del
+		{"/lcx/proxy/add", []string{"GET", "POST"}, needRole(ROLE_ADMIN), lcxProxyAddHandler},
+		{"/lcx/proxy/modify", []string{"GET", "POST"}, needRole(ROLE_ADMIN), lcxProxyModifyHandler},
+		{"/lcx/proxy/op", []string{"GET"}, lcxProxyOpRole, lcxProxyOpHandler},          //start/stop/del
+		{"/lcx/proxy/conns", []string{"GET"}, lcxProxyConnsRole, lcxProxyConnsHandler}, //list/kill
+		{"/lcx/agents", []string{"GET"}, needRole(ROLE_VIEWER), agentListHandler},
+		{"/metrics", []string{"GET"}, needRole(ROLE_VIEWER), metricsHandler},
+		{"/ws", []string{"GET"}, websocketRole, websocketHandler},
+	}
+}
+
+func newApiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, r := range getLegacyRoutes() {
+		mux.HandleFunc(r.Path, authWrap(r.Role, r.Handler))
+	}
+	registerApi(mux)
+	return mux
+}
+
 func lcxHandler(resp http.ResponseWriter, req *http.Request) {
 	op := req.FormValue("op")
 	switch op {
@@ -164,10 +353,12 @@ func lcxProxyListHandler(resp http.ResponseWriter, req *http.Request) {
 }
 
 type errRsp struct {
-	Result int
-	ErrMsg string
-	Id     int
-	Status int
+	Result  int
+	ErrMsg  string
+	Id      int
+	Status  int
+	Drained int //sessions finished during stop
+	Killed  int //sessions closed by stop
 }
 
 func (e *errRsp) ToJson() []byte {
@@ -196,16 +387,16 @@ func lcxProxyHandler(resp http.ResponseWriter, req *http.Request) {
 			err := pi.start()
 			if err != nil {
 				log.Println(err)
-				var rsp = errRsp{1, err.Error(), pi.Id, pi.Status}
+				var rsp = errRsp{1, err.Error(), pi.Id, pi.getStatus(), 0, 0}
 				resp.Write(rsp.ToJson())
 			} else {
 				fmt.Println("After start1:", pi)
-				var rsp = errRsp{0, "Success", pi.Id, pi.Status}
+				var rsp = errRsp{0, "Success", pi.Id, pi.getStatus(), 0, 0}
 				resp.Write(rsp.ToJson())
 			}
 		case "stop":
-			pi.stop()
-			var rsp = errRsp{0, "Success", pi.Id, pi.Status}
+			drained, killed := pi.stop()
+			var rsp = errRsp{0, "Success", pi.Id, pi.getStatus(), drained, killed}
 			resp.Write(rsp.ToJson())
 		default:
 			resp.Write(pi.ToJson())
@@ -219,6 +410,39 @@ func lcxProxyHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func lcxProxyConnsHandler(resp http.ResponseWriter, req *http.Request) {
+	id := req.FormValue("id")
+	op := req.FormValue("op")
+
+	pi, _ := proxies.get(id)
+	if pi == nil {
+		resp.Write([]byte("Proxy " + id + " not found"))
+		return
+	}
+
+	switch op {
+	case "":
+		j, err := json.Marshal(pi.getConnInfos())
+		if err != nil {
+			fmt.Println("Failed to marshal connections of proxy", id, err)
+			return
+		}
+		resp.Write(j)
+	case "kill":
+		var rsp = errRsp{0, "Success", pi.Id, pi.getStatus(), 0, 0}
+		connId, err := strconv.Atoi(req.FormValue("conn"))
+		if err != nil || !pi.killConn(connId) {
+			rsp.Result = 1
+			rsp.ErrMsg = "Connection " + req.FormValue("conn") + " not found"
+		} else {
+			rsp.Killed = 1
+		}
+		resp.Write(rsp.ToJson())
+	default:
+		resp.Write([]byte("Unknown operation:" + op))
+	}
+}
+
 func getFormData(req *http.Request, includeId bool) (*ProxyItem, error) {
 	var idn int
 	var lportn int
@@ -245,51 +469,112 @@ func getFormData(req *http.Request, includeId bool) (*ProxyItem, error) {
 		}
 	}
 
-	lip := req.FormValue("localip")
-	if lip == "" {
-		errstr += "Param localip missing"
-		paramOk = false
+	ltype := req.FormValue("type")
+	rtype := req.FormValue("remotetype")
+	if rtype == "" {
+		rtype = ltype
 	}
 
-	lport := req.FormValue("localport")
-	if lport == "" {
-		errstr += "Param localip missing"
-		paramOk = false
-	}
-	lportn, err = strconv.Atoi(lport)
-	if err != nil {
-		paramOk = false
-		allerr = fmt.Errorf("failed to convert lport: %v", err)
-	}
+	var lip, rip string
+	lpath := req.FormValue("localpath")
+	rpath := req.FormValue("remotepath")
 
-	rip := req.FormValue("remoteip")
-	if rip == "" {
-		errstr += "Param localip missing"
-		paramOk = false
-	}
+	if ltype == "unix" {
+		if lpath == "" {
+			errstr += "Param localpath missing"
+			paramOk = false
+		}
+	} else {
+		lip = req.FormValue("localip")
+		if lip == "" {
+			errstr += "Param localip missing"
+			paramOk = false
+		}
 
-	rport := req.FormValue("remoteport")
-	if rport == "" {
-		errstr += "Param localip missing"
-		paramOk = false
+		lport := req.FormValue("localport")
+		if lport == "" {
+			errstr += "Param localip missing"
+			paramOk = false
+		}
+		lportn, err = strconv.Atoi(lport)
+		if err != nil {
+			paramOk = false
+			allerr = fmt.Errorf("failed to convert lport: %v", err)
+		}
 	}
-	rportn, err = strconv.Atoi(rport)
-	if err != nil {
-		paramOk = false
-		allerr = fmt.Errorf("failed to convert lport: %v", allerr)
+
+	if rtype == "unix" {
+		if rpath == "" {
+			errstr += "Param remotepath missing"
+			paramOk = false
+		}
+	} else {
+		rip = req.FormValue("remoteip")
+		if rip == "" {
+			errstr += "Param localip missing"
+			paramOk = false
+		}
+
+		rport := req.FormValue("remoteport")
+		if rport == "" {
+			errstr += "Param localip missing"
+			paramOk = false
+		}
+		rportn, err = strconv.Atoi(rport)
+		if err != nil {
+			paramOk = false
+			allerr = fmt.Errorf("failed to convert lport: %v", allerr)
+		}
 	}
 
 	desc := req.FormValue("desc")
 
+	var drainTimeoutn int
+	drainTimeout := req.FormValue("draintimeout")
+	if drainTimeout != "" {
+		drainTimeoutn, err = strconv.Atoi(drainTimeout)
+		if err != nil {
+			paramOk = false
+			allerr = fmt.Errorf("failed to convert draintimeout: %v", err)
+		}
+	}
+
+	var udpTimeoutn int
+	udpTimeout := req.FormValue("udptimeout")
+	if udpTimeout != "" {
+		udpTimeoutn, err = strconv.Atoi(udpTimeout)
+		if err != nil {
+			paramOk = false
+			allerr = fmt.Errorf("failed to convert udptimeout: %v", err)
+		}
+	}
+
 	if paramOk {
 		ppi = &ProxyItem{
 			Id:         idn,
 			Desc:       desc,
+			Group:      req.FormValue("group"),
+			Tags:       splitList(req.FormValue("tags")),
 			LocalIp:    lip,
 			LocalPort:  lportn,
 			RemoteIp:   rip,
 			RemotePort: rportn,
+			Mode:       req.FormValue("mode"),
+			Type:       ltype,
+			RemoteType: req.FormValue("remotetype"),
+			LocalPath:  lpath,
+			RemotePath: rpath,
+			SockMode:   req.FormValue("sockmode"),
+			Agent:      req.FormValue("agent"),
+			Allow:      splitList(req.FormValue("allow")),
+			Deny:       splitList(req.FormValue("deny")),
+			UdpTimeout: udpTimeoutn,
+
+			DrainTimeout:    drainTimeoutn,
+			SshAgentForward: req.FormValue("sshagentforward") == "true",
+			SshAgentAuth:    req.FormValue("sshagentauth") == "true",
 		}
+		allerr = ppi.checkParam(includeId)
 	} else {
 		allerr = fmt.Errorf("%s %v", errstr, allerr)
 	}
@@ -297,6 +582,7 @@ func getFormData(req *http.Request, includeId bool) (*ProxyItem, error) {
 	return ppi, allerr
 }
 
+// only config attributes are taken from body, runtime attributes like Status are ignored
 func getBodyData(req *http.Request, includeId bool) (*ProxyItem, error) {
 	var pi = &ProxyItem{}
 	var err error
@@ -308,10 +594,12 @@ func getBodyData(req *http.Request, includeId bool) (*ProxyItem, error) {
 		fmt.Println("Failed to read post body, ", err)
 	} else {
 		fmt.Println("Add request body: ", body)
-		err = json.Unmarshal(body, &pi)
+		var bp ProxyItem
+		err = json.Unmarshal(body, &bp)
 		if err != nil {
 			fmt.Println("Failed to unmarshal request json, ", err)
 		} else {
+			pi = bp.config()
 			err = pi.checkParam(includeId)
 		}
 	}
@@ -376,8 +664,6 @@ func lcxProxyModifyHandler(resp http.ResponseWriter, req *http.Request) {
 func lcxProxyOpHandler(resp http.ResponseWriter, req *http.Request) {
 	var paramOk = true
 
-	resp.Write([]byte("lcx modify handled"))
-
 	id := req.FormValue("id")
 	if id == "" {
 		resp.Write([]byte("Param id missing"))
@@ -402,7 +688,9 @@ func lcxProxyOpHandler(resp http.ResponseWriter, req *http.Request) {
 			proxies.del(id)
 		default:
 			resp.Write([]byte("Unknown operation:" + op))
+			return
 		}
+		resp.Write([]byte("lcx op handled"))
 	}
 }
 
@@ -418,6 +706,8 @@ func websocketHandler(resp http.ResponseWriter, req *http.Request) {
 		doTermConnect(resp, req, id)
 	case "wscomm":
 		doWsComm(resp, req)
+	case "agent":
+		doAgentConnect(resp, req)
 	default:
 		resp.Write([]byte("Unknown operation:" + op))
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runtime attributes in the body of legacy add are ignored, so the proxy can be deleted
+func TestLegacyAddIgnoresStatus(t *testing.T) {
+	old := proxies
+	proxies = newTestProxyList(t)
+	t.Cleanup(func() { proxies = old })
+
+	body := `{"Type":"tcp","LocalIp":"127.0.0.1","LocalPort":` + strconv.Itoa(freePort(t)) +
+		`,"RemoteIp":"127.0.0.1","RemotePort":22,"Status":1,"Instances":3,"LastError":"x"}`
+	resp := httptest.NewRecorder()
+	lcxProxyAddHandler(resp, httptest.NewRequest("POST", "/lcx/proxy/add", strings.NewReader(body)))
+
+	var p ProxyItem
+	err := json.Unmarshal(resp.Body.Bytes(), &p)
+	if err != nil {
+		t.Fatalf("unexpected response %s", resp.Body)
+	}
+	if p.Status != STATUS_STOPPED || p.Instances != 0 || p.LastError != "" {
+		t.Fatalf("runtime attributes taken from request: %s", resp.Body)
+	}
+
+	resp = httptest.NewRecorder()
+	lcxProxyOpHandler(resp, httptest.NewRequest("GET", "/lcx/proxy/op?op=del&id="+strconv.Itoa(p.Id), nil))
+	if pi, _ := proxies.getN(p.Id); pi != nil {
+		t.Fatalf("proxy not deleted: %s", resp.Body)
+	}
+}
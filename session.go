@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TermSession is a live web terminal session, others can join it as observers
+type TermSession struct {
+	Id        int
+	ProxyId   int
+	Owner     string //web user who opened the terminal
+	Target    string
+	TermType  string
+	Start     string
+	Observers []TermObserver
+}
+
+// frames queued for an observer, it is dropped when the queue is full
+const TERM_OBSERVER_QUEUE = 256
+
+// max time to write a frame to an observer
+const TERM_OBSERVER_TIMEOUT = 10 * time.Second
+
+// TermObserver is a web user who joined a session of another user
+type TermObserver struct {
+	Id       int
+	User     string
+	ReadOnly bool
+	Pending  bool //asked for input, waiting for the owner to allow it
+	Waiting  bool //joined without admin role, sees nothing until the owner allows watching
+	Since    string
+}
+
+// text or control frame to an observer
+type termFrame struct {
+	text []byte
+	ctrl *termCtrl
+}
+
+// output of observer is written by its own goroutine, so a slow observer
+// never blocks the owner and the recording
+type termObserver struct {
+	TermObserver
+	conn *termConn
+	out  chan termFrame
+	done chan struct{} //closed when removed from session
+	bye  string        //last message to observer when removed
+}
+
+// termSession owns the ssh or telnet conn, output goes to owner, observers
+// and recorder, input of owner and observers with input goes to input
+type termSession struct {
+	lock      sync.Mutex
+	info      TermSession
+	conn      *termConn //owner
+	input     io.Writer //stdin of ssh session or telnet conn
+	inputLock sync.Mutex
+	rec       *termRecorder
+	observers []*termObserver
+	closed    bool
+}
+
+type TermSessionMgr struct {
+	lock     sync.Mutex
+	sessions map[int]*termSession
+	maxId    int
+	obsSeq   int
+}
+
+var termSessions = &TermSessionMgr{sessions: make(map[int]*termSession)}
+
+// register session of owner conn after login, recording starts from here
+func (sm *TermSessionMgr) add(conn *termConn, p *ProxyItem, owner string, input io.Writer) *termSession {
+	_, _, termType := p.getTermTarget()
+	var s = &termSession{
+		info: TermSession{
+			ProxyId:  p.Id,
+			Owner:    owner,
+			Target:   p.getTermRemote(),
+			TermType: termType,
+			Start:    time.Now().Format(time.RFC3339),
+		},
+		conn:  conn,
+		input: input,
+	}
+	cols, rows := conn.size()
+	s.rec = recordings.start(p, owner, cols, rows)
+
+	//observers follow size of owner
+	f := conn.resizeHandler()
+	conn.setResizeHandler(func(cols int, rows int) {
+		if f != nil {
+			f(cols, rows)
+		}
+		s.resized(cols, rows)
+	})
+
+	sm.lock.Lock()
+	sm.maxId++
+	s.info.Id = sm.maxId
+	sm.sessions[s.info.Id] = s
+	sm.lock.Unlock()
+
+	conn.setCtrlHandler(s.ctrl)
+
+	s.notify()
+	return s
+}
+
+func (sm *TermSessionMgr) get(id int) *termSession {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.sessions[id]
+}
+
+func (sm *TermSessionMgr) list() []TermSession {
+	sm.lock.Lock()
+	var items []*termSession
+	for _, s := range sm.sessions {
+		items = append(items, s)
+	}
+	sm.lock.Unlock()
+
+	var list = []TermSession{}
+	for _, s := range items {
+		list = append(list, s.getInfo())
+	}
+	slices.SortFunc(list, func(a, b TermSession) int { return a.Id - b.Id })
+	return list
+}
+
+func (s *termSession) getInfo() TermSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info := s.info
+	info.Observers = []TermObserver{}
+	for _, o := range s.observers {
+		info.Observers = append(info.Observers, o.TermObserver)
+	}
+	return info
+}
+
+// send session info to owner and observers
+func (s *termSession) notify() {
+	info := s.getInfo()
+	var c = &termCtrl{Type: TERM_CTRL_SESSION, Session: &info}
+	s.conn.writeCtrl(c)
+	s.broadcast(termFrame{ctrl: c})
+}
+
+func (s *termSession) resized(cols int, rows int) {
+	s.lock.Lock()
+	rec := s.rec
+	s.lock.Unlock()
+
+	if rec != nil {
+		rec.resize(cols, rows)
+	}
+	s.broadcast(termFrame{ctrl: &termCtrl{Type: TERM_CTRL_RESIZE, Cols: cols, Rows: rows}})
+}
+
+// queue frame to observers allowed to watch, the ones not keeping up are dropped
+func (s *termSession) broadcast(f termFrame) {
+	s.lock.Lock()
+	var obs []*termObserver
+	for _, o := range s.observers {
+		if !o.Waiting {
+			obs = append(obs, o)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, o := range obs {
+		select {
+		case o.out <- f:
+		default:
+			log.Println("Observer", o.Id, "of terminal session", s.info.Id, "is too slow, dropped")
+			s.kick(o.Id, "")
+		}
+	}
+}
+
+// write queued frames to observer until it is removed
+func (o *termObserver) writeLoop(s *termSession) {
+	defer o.conn.Close()
+	for {
+		select {
+		case f := <-o.out:
+			o.conn.SetWriteDeadline(time.Now().Add(TERM_OBSERVER_TIMEOUT))
+			var err error
+			if f.ctrl != nil {
+				err = o.conn.writeCtrl(f.ctrl)
+			} else {
+				err = o.conn.writeText(f.text)
+			}
+			if err != nil {
+				fmt.Println("Failed to write to observer", o.Id, err)
+				s.kick(o.Id, "")
+				return
+			}
+		case <-o.done:
+			if o.bye != "" {
+				o.conn.SetWriteDeadline(time.Now().Add(TERM_OBSERVER_TIMEOUT))
+				o.conn.writeText([]byte("\r\n" + o.bye + "\r\n"))
+			}
+			return
+		}
+	}
+}
+
+// write output to owner and recorder, then queue it to observers
+func (s *termSession) output(p []byte) error {
+	err := s.conn.writeText(p)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	rec := s.rec
+	s.lock.Unlock()
+
+	if rec != nil {
+		rec.output(p)
+	}
+	s.broadcast(termFrame{text: slices.Clone(p)})
+	return nil
+}
+
+// write input of owner to ssh or telnet
+func (s *termSession) Write(p []byte) (int, error) {
+	return s.writeInput(p, s.info.Owner)
+}
+
+// write input typed by user to ssh or telnet, it is recorded with the user
+func (s *termSession) writeInput(p []byte, user string) (int, error) {
+	s.inputLock.Lock()
+	defer s.inputLock.Unlock()
+
+	s.lock.Lock()
+	rec := s.rec
+	s.lock.Unlock()
+	if rec != nil {
+		rec.input(p, user)
+	}
+	return s.input.Write(p)
+}
+
+// owner is gone or remote closed, observers are disconnected
+func (s *termSession) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	obs := s.observers
+	s.observers = nil
+	rec := s.rec
+	s.lock.Unlock()
+
+	termSessions.lock.Lock()
+	delete(termSessions.sessions, s.info.Id)
+	termSessions.lock.Unlock()
+
+	if rec != nil {
+		rec.close()
+	}
+	for _, o := range obs {
+		o.bye = "Session closed by owner"
+		close(o.done)
+	}
+}
+
+// join session as observer, input needs approval of the owner, so does watching if waiting.
+// the owner is told in the terminal
+func (s *termSession) join(conn *termConn, user string, wantInput bool, waiting bool) *termObserver {
+	termSessions.lock.Lock()
+	termSessions.obsSeq++
+	id := termSessions.obsSeq
+	termSessions.lock.Unlock()
+
+	var o = &termObserver{
+		TermObserver: TermObserver{
+			Id:       id,
+			User:     user,
+			ReadOnly: true,
+			Pending:  wantInput,
+			Waiting:  waiting,
+			Since:    time.Now().Format(time.RFC3339),
+		},
+		conn: conn,
+		out:  make(chan termFrame, TERM_OBSERVER_QUEUE),
+		done: make(chan struct{}),
+	}
+
+	note := "User " + user + " joined as observer"
+	if waiting {
+		o.out <- termFrame{text: []byte("Waiting for owner to allow watching\r\n")}
+		note = "User " + user + " asks to watch, allow or deny it above"
+	} else {
+		cols, rows := s.conn.size()
+		o.out <- termFrame{ctrl: &termCtrl{Type: TERM_CTRL_RESIZE, Cols: cols, Rows: rows}}
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.observers = append(s.observers, o)
+	s.lock.Unlock()
+
+	go o.writeLoop(s)
+	s.conn.writeText([]byte("\r\n[" + note + "]\r\n"))
+	s.notify()
+	return o
+}
+
+// observer may write input now
+func (s *termSession) canInput(id int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	idx := slices.IndexFunc(s.observers, func(o *termObserver) bool { return o.Id == id })
+	return idx >= 0 && !s.observers[idx].ReadOnly
+}
+
+// allow or deny watching of a waiting observer, or input of others, false if not found
+func (s *termSession) grant(id int, allow bool) bool {
+	s.lock.Lock()
+	idx := slices.IndexFunc(s.observers, func(o *termObserver) bool { return o.Id == id })
+	if idx < 0 {
+		s.lock.Unlock()
+		return false
+	}
+	o := s.observers[idx]
+	waiting := o.Waiting
+	if waiting {
+		o.Waiting = !allow
+	} else {
+		o.ReadOnly = !allow
+		o.Pending = false
+	}
+	s.lock.Unlock()
+
+	if waiting && !allow {
+		log.Println("Terminal session", s.info.Id, "of", s.info.Owner+": watching denied for", o.User)
+		return s.kick(id, "Watching denied by owner")
+	}
+
+	msg := "Input denied by owner"
+	if waiting {
+		msg = "Watching allowed by owner"
+		cols, rows := s.conn.size()
+		select {
+		case o.out <- termFrame{ctrl: &termCtrl{Type: TERM_CTRL_RESIZE, Cols: cols, Rows: rows}}:
+		default:
+		}
+	} else if allow {
+		msg = "Input allowed by owner"
+	}
+	log.Println("Terminal session", s.info.Id, "of", s.info.Owner+":", msg, "for", o.User)
+	select {
+	case o.out <- termFrame{text: []byte("\r\n" + msg + "\r\n")}:
+	default:
+	}
+	s.notify()
+	return true
+}
+
+// control messages from owner
+func (s *termSession) ctrl(c *termCtrl) {
+	switch c.Type {
+	case TERM_CTRL_GRANT:
+		if !s.grant(c.Observer, c.Allow) {
+			fmt.Println("Observer", c.Observer, "of session", s.info.Id, "not found")
+		}
+	default:
+		fmt.Println("Unknown terminal control message", c.Type)
+	}
+}
+
+// remove observer and close its conn with msg, false if not found
+func (s *termSession) kick(id int, msg string) bool {
+	s.lock.Lock()
+	idx := slices.IndexFunc(s.observers, func(o *termObserver) bool { return o.Id == id })
+	if idx < 0 {
+		s.lock.Unlock()
+		return false
+	}
+	o := s.observers[idx]
+	s.observers = slices.Delete(s.observers, idx, idx+1)
+	s.lock.Unlock()
+
+	o.bye = msg
+	close(o.done)
+	s.notify()
+	return true
+}
+
+// /ws?op=termconnect&id=P&session=S&mode=rw, read only until the owner allows
+// input if mode is rw. users other than admins and the owner wait for the owner to allow watching
+func doTermJoin(conn *termConn, p *ProxyItem, sid string, user string, readOnly bool, admin bool) {
+	id, _ := strconv.Atoi(sid)
+	s := termSessions.get(id)
+	if s == nil || s.info.ProxyId != p.Id {
+		conn.writeText([]byte("Session " + sid + " of proxy " + strconv.Itoa(p.Id) + " not exist\r\n"))
+		conn.Close()
+		return
+	}
+
+	o := s.join(conn, user, !readOnly, !admin && user != s.info.Owner)
+	if o == nil {
+		conn.Close()
+		return
+	}
+	log.Println("User", user, "joined terminal session", id, "of", s.info.Owner, "asked for input", !readOnly, "waiting", o.Waiting)
+
+	go func() {
+		for {
+			msg, err := conn.readData()
+			if err != nil {
+				fmt.Println("Observer", o.Id, "of session", id, "left", err)
+				break
+			}
+			if !s.canInput(o.Id) {
+				continue
+			}
+			_, err = s.writeInput(msg, user)
+			if err != nil {
+				fmt.Println("Failed to write input of observer", o.Id, err)
+				break
+			}
+		}
+		if s.kick(o.Id, "") {
+			log.Println("User", user, "left terminal session", id)
+		}
+	}()
+}
+
+// /api/v2/sessions
+func apiSessionsHandler(resp http.ResponseWriter, req *http.Request) {
+	writeApiJson(resp, http.StatusOK, termSessions.list())
+}
+
+// /api/v2/sessions/{id}
+func apiSessionHandler(resp http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(req.PathValue("id"))
+	s := termSessions.get(id)
+	if s == nil {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "Session "+req.PathValue("id")+" not found")
+		return
+	}
+	writeApiJson(resp, http.StatusOK, s.getInfo())
+}
+
+// /api/v2/sessions/{id}/observers/{observer}, kicked by owner or admin
+func apiSessionObserverHandler(resp http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(req.PathValue("id"))
+	s := termSessions.get(id)
+	if s == nil {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "Session "+req.PathValue("id")+" not found")
+		return
+	}
+
+	u := getReqUser(req)
+	if u != nil && u.roleLevel() < ROLE_ADMIN && s.info.Owner != u.Name {
+		writeApiError(resp, http.StatusForbidden, API_ERR_FORBIDDEN, "Not owner of session")
+		return
+	}
+
+	oid, _ := strconv.Atoi(req.PathValue("observer"))
+	if !s.kick(oid, "Kicked by "+getReqUserName(req)) {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "Observer "+req.PathValue("observer")+" not found")
+		return
+	}
+	log.Println("User", getReqUserName(req), "kicked observer", oid, "from terminal session", id)
+	resp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// master key of ssh keys file is read from this env first
+const MASTER_KEY_ENV = "LCX_MASTER_KEY"
+
+// SshKey is a private key used by web terminal to login, the private part is never returned
+type SshKey struct {
+	Id          int
+	Name        string
+	Owner       string //user who can use the key, empty for proxy key
+	ProxyId     int    //proxy whose terminal uses the key, 0 for user key
+	User        string //login user, prompted if empty
+	PublicKey   string //authorized_keys format
+	Fingerprint string
+	Created     string
+}
+
+// sshKeyCfg is saved in ssh keys file
+type sshKeyCfg struct {
+	SshKey
+	Data string //private key pem encrypted by master key, base64
+}
+
+// request to import or generate a key
+type sshKeyReq struct {
+	Name       string
+	ProxyId    int
+	User       string
+	PrivateKey string //pem, ed25519 key is generated if empty
+	Passphrase string //of PrivateKey, it is stored without passphrase
+}
+
+type SshKeyMgr struct {
+	lock       sync.Mutex
+	fileName   string
+	masterFile string
+	master     []byte //aes-256 key
+	keys       []*sshKeyCfg
+	maxId      int
+}
+
+var sshKeys = &SshKeyMgr{}
+
+func (km *SshKeyMgr) load(fileName string, masterFile string) error {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	km.fileName = fileName
+	km.masterFile = masterFile
+
+	buf, err := os.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(buf, &km.keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, k := range km.keys {
+		km.maxId = max(km.maxId, k.Id)
+	}
+	return km.loadMaster()
+}
+
+// master key is from env, or key file which is created with the first key
+func (km *SshKeyMgr) loadMaster() error {
+	if s := os.Getenv(MASTER_KEY_ENV); s != "" {
+		h := sha256.Sum256([]byte(s))
+		km.master = h[:]
+		return nil
+	}
+
+	buf, err := os.ReadFile(km.masterFile)
+	if err == nil {
+		km.master, err = hex.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(km.master) != 32 {
+			return fmt.Errorf("invalid master key file %s", km.masterFile)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if len(km.keys) > 0 {
+		return fmt.Errorf("master key file %s missing, saved ssh keys can not be used", km.masterFile)
+	}
+
+	var key = make([]byte, 32)
+	rand.Read(key)
+	err = os.WriteFile(km.masterFile, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	log.Println("Created ssh master key file", km.masterFile, ", keep it with", km.fileName)
+	km.master = key
+	return nil
+}
+
+func (km *SshKeyMgr) save() error {
+	j, err := json.MarshalIndent(km.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(km.fileName, j, 0, 0600)
+}
+
+func (km *SshKeyMgr) encrypt(plain []byte) (string, error) {
+	if km.master == nil {
+		return "", fmt.Errorf("no master key")
+	}
+
+	block, err := aes.NewCipher(km.master)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce = make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func (km *SshKeyMgr) decrypt(data string) ([]byte, error) {
+	if km.master == nil {
+		return nil, fmt.Errorf("no master key")
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(km.master)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted key too short")
+	}
+	return gcm.Open(nil, buf[:gcm.NonceSize()], buf[gcm.NonceSize():], nil)
+}
+
+// import or generate key, return the saved key
+func (km *SshKeyMgr) add(owner string, kr *sshKeyReq) (*SshKey, error) {
+	var raw any
+	var err error
+
+	if kr.PrivateKey == "" {
+		_, raw, err = ed25519.GenerateKey(rand.Reader)
+	} else if kr.Passphrase != "" {
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase([]byte(kr.PrivateKey), []byte(kr.Passphrase))
+	} else {
+		raw, err = ssh.ParseRawPrivateKey([]byte(kr.PrivateKey))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(raw, kr.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	data, err := km.encrypt(pem.EncodeToMemory(block))
+	if err != nil {
+		return nil, err
+	}
+
+	km.maxId++
+	var k = &sshKeyCfg{
+		SshKey: SshKey{
+			Id:          km.maxId,
+			Name:        kr.Name,
+			Owner:       owner,
+			ProxyId:     kr.ProxyId,
+			User:        kr.User,
+			PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " " + kr.Name,
+			Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+			Created:     time.Now().Format(time.RFC3339),
+		},
+		Data: data,
+	}
+	if k.ProxyId != 0 {
+		k.Owner = ""
+	}
+
+	km.keys = append(km.keys, k)
+	err = km.save()
+	if err != nil {
+		km.keys = km.keys[:len(km.keys)-1]
+		return nil, err
+	}
+
+	key := k.SshKey
+	return &key, nil
+}
+
+func (km *SshKeyMgr) get(id int) *SshKey {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	for _, k := range km.keys {
+		if k.Id == id {
+			key := k.SshKey
+			return &key
+		}
+	}
+	return nil
+}
+
+func (km *SshKeyMgr) del(id int) error {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	for i, k := range km.keys {
+		if k.Id == id {
+			km.keys = append(km.keys[:i], km.keys[i+1:]...)
+			return km.save()
+		}
+	}
+	return fmt.Errorf("ssh key %d not exist", id)
+}
+
+// delete keys of a deleted proxy, so a proxy reusing its id does not get them
+func (km *SshKeyMgr) delProxy(proxyId int) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	var keys = km.keys[:0:0]
+	for _, k := range km.keys {
+		if k.ProxyId != proxyId || proxyId == 0 {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == len(km.keys) {
+		return
+	}
+
+	log.Println("Deleting", len(km.keys)-len(keys), "ssh keys of proxy", proxyId)
+	km.keys = keys
+	err := km.save()
+	if err != nil {
+		log.Println("Failed to save ssh keys", km.fileName, err)
+	}
+}
+
+// keys visible to user, nil user sees all
+func (km *SshKeyMgr) list(u *authUser) []SshKey {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	var list = []SshKey{}
+	for _, k := range km.keys {
+		if u == nil || u.roleLevel() >= ROLE_ADMIN || k.ProxyId != 0 || k.Owner == u.Name {
+			list = append(list, k.SshKey)
+		}
+	}
+	return list
+}
+
+// get signers of proxy keys then user keys, and login user of the first key which has one
+func (km *SshKeyMgr) signers(proxyId int, owner string) ([]ssh.Signer, string) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+
+	var proxyKeys, userKeys []ssh.Signer
+	var proxyUser, userUser string
+	for _, k := range km.keys {
+		if k.ProxyId != proxyId && (k.ProxyId != 0 || k.Owner != owner) {
+			continue
+		}
+
+		buf, err := km.decrypt(k.Data)
+		if err != nil {
+			log.Println("Failed to decrypt ssh key", k.Id, err)
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(buf)
+		if err != nil {
+			log.Println("Failed to parse ssh key", k.Id, err)
+			continue
+		}
+
+		if k.ProxyId != 0 {
+			proxyKeys = append(proxyKeys, signer)
+			if proxyUser == "" {
+				proxyUser = k.User
+			}
+		} else {
+			userKeys = append(userKeys, signer)
+			if userUser == "" {
+				userUser = k.User
+			}
+		}
+	}
+
+	if proxyUser == "" {
+		proxyUser = userUser
+	}
+	return append(proxyKeys, userKeys...), proxyUser
+}
+
+// connect to ssh-agent of -sshagent for proxy which enabled SshAgentAuth, nil if not
+func dialSshAgent(p *ProxyItem) (agent.ExtendedAgent, net.Conn) {
+	if cfg.sshAgent == "" || !p.getSshAgentAuth() {
+		return nil, nil
+	}
+
+	conn, err := net.Dial("unix", cfg.sshAgent)
+	if err != nil {
+		log.Println("Failed to connect ssh-agent", cfg.sshAgent, err)
+		return nil, nil
+	}
+	return agent.NewClient(conn), conn
+}
+
+func initSshKeys() {
+	err := sshKeys.load(cfg.sshKeysFile, cfg.masterKeyFile)
+	if err != nil {
+		log.Println("Failed to load ssh keys", cfg.sshKeysFile, err)
+	}
+}
+
+// /api/v2/sshkeys
+func apiSshKeysHandler(resp http.ResponseWriter, req *http.Request) {
+	u := getReqUser(req)
+
+	switch req.Method {
+	case http.MethodGet:
+		writeApiJson(resp, http.StatusOK, sshKeys.list(u))
+	case http.MethodPost:
+		var kr sshKeyReq
+		if !apiDecodeBody(resp, req, &kr) {
+			return
+		}
+
+		if kr.Name == "" {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, "Key name is empty")
+			return
+		}
+		if kr.ProxyId != 0 {
+			if u != nil && u.roleLevel() < ROLE_ADMIN {
+				writeApiError(resp, http.StatusForbidden, API_ERR_FORBIDDEN, "Only admin can add proxy keys")
+				return
+			}
+			if pi, _ := proxies.getN(kr.ProxyId); pi == nil {
+				writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, "Proxy "+strconv.Itoa(kr.ProxyId)+" not found")
+				return
+			}
+		}
+
+		key, err := sshKeys.add(getReqUserName(req), &kr)
+		if err != nil {
+			writeApiError(resp, http.StatusBadRequest, API_ERR_INVALID_PARAM, err.Error())
+			return
+		}
+		log.Println("User", getReqUserName(req), "added ssh key", key.Id, key.Name, key.Fingerprint)
+		resp.Header().Set("Location", fmt.Sprintf("/api/v2/sshkeys/%d", key.Id))
+		writeApiJson(resp, http.StatusCreated, key)
+	}
+}
+
+// /api/v2/sshkeys/{id}
+func apiSshKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	u := getReqUser(req)
+	id, _ := strconv.Atoi(req.PathValue("id"))
+	key := sshKeys.get(id)
+	if key == nil {
+		writeApiError(resp, http.StatusNotFound, API_ERR_NOT_FOUND, "SSH key "+req.PathValue("id")+" not found")
+		return
+	}
+
+	if u != nil && u.roleLevel() < ROLE_ADMIN && key.Owner != u.Name {
+		writeApiError(resp, http.StatusForbidden, API_ERR_FORBIDDEN, "Not owner of ssh key")
+		return
+	}
+
+	err := sshKeys.del(id)
+	if err != nil {
+		writeApiError(resp, http.StatusInternalServerError, API_ERR_INTERNAL_ERROR, err.Error())
+		return
+	}
+	log.Println("User", getReqUserName(req), "deleted ssh key", id, key.Name)
+	resp.WriteHeader(http.StatusNoContent)
+}
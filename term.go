@@ -3,55 +3,124 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 	"github.com/ziutek/telnet"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-func doTelnetComm(wsConn net.Conn, p *ProxyItem) {
-	tcon, err := telnet.Dial(p.Type, p.getLocalAddr())
+// telnet option negotiation bytes used for NAWS, RFC 1073
+const (
+	TELNET_IAC  = 255
+	TELNET_WILL = 251
+	TELNET_SB   = 250
+	TELNET_SE   = 240
+	TELNET_NAWS = 31
+)
+
+// nawsConn is the raw conn under telnet.Conn. ziutek/telnet answers DO NAWS
+// with 65535x65535, replace it by the terminal size and report later resizes
+type nawsConn struct {
+	net.Conn
+	lock    sync.Mutex
+	term    *termConn
+	enabled bool //server has asked for NAWS
+	inSub   bool //size of NAWS subnegotiation is the next write
+}
+
+// IAC SB NAWS WIDTH[2] HEIGHT[2] IAC SE, 255 in size is doubled
+func nawsSize(cols int, rows int) []byte {
+	var buf = []byte{TELNET_IAC, TELNET_SB, TELNET_NAWS}
+	for _, b := range []byte{byte(cols >> 8), byte(cols), byte(rows >> 8), byte(rows)} {
+		buf = append(buf, b)
+		if b == TELNET_IAC {
+			buf = append(buf, b)
+		}
+	}
+	return append(buf, TELNET_IAC, TELNET_SE)
+}
+
+// telnet.Conn escapes IAC in data, so these commands are only written by its negotiation
+func (nc *nawsConn) Write(b []byte) (int, error) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	switch {
+	case slices.Equal(b, []byte{TELNET_IAC, TELNET_WILL, TELNET_NAWS}):
+		nc.enabled = true
+	case slices.Equal(b, []byte{TELNET_IAC, TELNET_SB, TELNET_NAWS}):
+		nc.inSub = true
+		return len(b), nil
+	case nc.inSub && slices.Equal(b, []byte{255, 255, 255, 255}):
+		nc.inSub = false
+		sub := nawsSize(nc.term.size())
+		_, err := nc.Conn.Write(sub[:len(sub)-2])
+		return len(b), err
+	}
+	return nc.Conn.Write(b)
+}
+
+func (nc *nawsConn) resize(cols int, rows int) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	//size in negotiation will be the new one
+	if !nc.enabled || nc.inSub {
+		return
+	}
+	_, err := nc.Conn.Write(nawsSize(cols, rows))
+	if err != nil {
+		fmt.Println("Failed to send telnet window size", err)
+	}
+}
+
+func doTelnetComm(wsConn *termConn, p *ProxyItem, owner string) {
+	network, addr, _ := p.getTermTarget()
+	rawConn, err := net.Dial(network, addr)
 	if err != nil {
 		fmt.Println("Failed to connect telnet", err)
 		wsConn.Close()
 		return
 	}
+	var nc = &nawsConn{Conn: rawConn, term: wsConn}
+	tcon, _ := telnet.NewConn(nc)
+	wsConn.setResizeHandler(nc.resize)
+	sess := termSessions.add(wsConn, p, owner, tcon)
 
-	//var wsstderr = &wsio{wsConn, true}
-	var wsstdother = &wsio{wsConn, false}
+	//var wsstderr = &wsio{sess: sess, isStdErr: true}
+	var wsstdother = &wsio{sess: sess}
 
 	go func() {
 		defer wsConn.Close()
 		defer tcon.Close()
+		defer sess.close()
 
-		exitCh := make(chan int)
+		exitCh := make(chan int, 2)
 
-		//read
+		//read, io.Copy returns nil at EOF
 		go func() {
-			for {
-				//read from telnet, write to user
-				_, err := io.Copy(wsstdother, tcon)
-				if err != nil {
-					fmt.Println("Failed to copy data from telnet to user")
-					break
-				}
+			//read from telnet, write to user
+			_, err := io.Copy(wsstdother, tcon)
+			if err != nil {
+				fmt.Println("Failed to copy data from telnet to user", err)
 			}
-
 			exitCh <- 1
 		}()
 		//write
 		go func() {
-			for {
-				//read from user, write to telnet
-				_, err := io.Copy(tcon, wsstdother)
-				if err != nil {
-					fmt.Println("Failed to copy data from user to telnet")
-					break
-				}
+			//read from user, write to telnet
+			_, err := io.Copy(sess, wsstdother)
+			if err != nil {
+				fmt.Println("Failed to copy data from user to telnet", err)
 			}
-
 			exitCh <- 2
 		}()
 
@@ -61,60 +130,125 @@ func doTelnetComm(wsConn net.Conn, p *ProxyItem) {
 	}()
 }
 
-func doSshComm(conn net.Conn, p *ProxyItem) {
-	//get user
-	user, err := getWsEcho(conn, PROMPT_USER)
-	if err != nil {
-		conn.Close()
-		return
+// auth methods of terminal login, tried in order: saved keys and ssh-agent,
+// then keyboard-interactive and password prompted in terminal
+func getSshAuthMethods(conn *termConn, signers []ssh.Signer, ag agent.ExtendedAgent) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if len(signers) > 0 || ag != nil {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var list = slices.Clone(signers)
+			if ag != nil {
+				as, err := ag.Signers()
+				if err != nil {
+					fmt.Println("Failed to get signers from ssh-agent", err)
+				}
+				list = append(list, as...)
+			}
+			return list, nil
+		}))
 	}
 
-	//get password
-	pass, err := getWsEcho(conn, PROMPT_PASSWORD)
-	if err != nil {
-		conn.Close()
-		return
+	methods = append(methods, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		var info = strings.TrimSpace(name + "\n" + instruction)
+		if info != "" {
+			wsutil.WriteServerText(conn, []byte(strings.ReplaceAll(info, "\n", "\r\n")+"\r\n"))
+		}
+
+		var answers = make([]string, len(questions))
+		for i, q := range questions {
+			var err error
+			answers[i], err = getWsInput(conn, q, echos[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return answers, nil
+	}))
+
+	methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+		return getWsEcho(conn, PROMPT_PASSWORD)
+	}))
+	return methods
+}
+
+// owner is the web user, whose keys are used besides keys of proxy
+func doSshComm(conn *termConn, p *ProxyItem, owner string) {
+	signers, user := sshKeys.signers(p.Id, owner)
+	ag, agConn := dialSshAgent(p)
+	closeAgent := func() {
+		if agConn != nil {
+			agConn.Close()
+		}
+	}
+
+	//get user if no key has one
+	var err error
+	if user == "" {
+		user, err = getWsEcho(conn, PROMPT_USER)
+		if err != nil {
+			closeAgent()
+			conn.Close()
+			return
+		}
 	}
 
 	var sshcfg = &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(pass),
-		},
-		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			if cfg.debug {
-				fmt.Println("Host key received, hostname", hostname, ",addr:", remote.String(), ",key:", key)
-			}
-			return nil
-		}),
+		User:            user,
+		Auth:            getSshAuthMethods(conn, signers, ag),
+		HostKeyCallback: hostKeys.callback(conn, p, owner),
+		//prefer known key types, or a server with several keys may send one not known yet
+		HostKeyAlgorithms: hostKeys.algorithms(hostKeyName(p)),
 	}
 
-	client, err := ssh.Dial(p.Type, p.getLocalAddr(), sshcfg)
+	network, addr, _ := p.getTermTarget()
+	client, err := ssh.Dial(network, addr, sshcfg)
 	if err != nil {
 		fmt.Println("Failed to connect ssh", p, err)
+		wsutil.WriteServerText(conn, []byte("\r\nFailed to connect ssh: "+err.Error()+"\r\n"))
+		closeAgent()
 		conn.Close()
 		return
 	}
+	log.Println("User", owner, "logged in ssh", user+"@"+addr, "of proxy", p.Id)
 
 	//client.SendRequest()
 	ss, err := client.NewSession()
 	if err != nil {
 		fmt.Println("Failed to create session", err)
+		client.Close()
+		closeAgent()
 		conn.Close()
 		return
 	}
 
+	if cfg.sshAgent != "" && p.getSshAgentForward() {
+		err = agent.ForwardToRemote(client, cfg.sshAgent)
+		if err == nil {
+			err = agent.RequestAgentForwarding(ss)
+		}
+		if err != nil {
+			fmt.Println("Failed to forward ssh-agent", err)
+		}
+	}
+
 	modes := ssh.TerminalModes{
 		ssh.ECHO:          1,
 		ssh.TTY_OP_ISPEED: 14400,
 		ssh.TTY_OP_OSPEED: 14400,
 	}
-	rows := 40
-	cols := 120
+	//size sent by browser during login, later resizes are sent as window-change
+	cols, rows := conn.size()
 	err = ss.RequestPty("xterm", rows, cols, modes)
 	if err != nil {
 		fmt.Println("Failed to request pty", err)
 	}
+	conn.setResizeHandler(func(cols int, rows int) {
+		err := ss.WindowChange(rows, cols)
+		if err != nil {
+			fmt.Println("Failed to change window size", err)
+		}
+	})
 
 	writeIn, err := ss.StdinPipe()
 	if err != nil {
@@ -129,8 +263,9 @@ func doSshComm(conn net.Conn, p *ProxyItem) {
 		fmt.Println("Failed to get stderr pipe")
 	}
 
-	var wsstderr = &wsio{conn, true}
-	var wsstdother = &wsio{conn, false}
+	sess := termSessions.add(conn, p, owner, writeIn)
+	var wsstderr = &wsio{sess: sess, isStdErr: true}
+	var wsstdother = &wsio{sess: sess}
 
 	go func() {
 		var inBuf = make([]byte, 128)
@@ -138,13 +273,14 @@ func doSshComm(conn net.Conn, p *ProxyItem) {
 			nr, err := wsstdother.Read(inBuf)
 			if err != nil {
 				fmt.Println("Failed to read data from ws", err, "exiting read thread")
+				ss.Close()
 				return
 			}
 			if cfg.debug {
 				fmt.Println("Readed", nr, "bytes from ws", inBuf[:nr])
 			}
 
-			nw, err := writeIn.Write(inBuf[:nr])
+			nw, err := sess.Write(inBuf[:nr])
 			if err != nil {
 				fmt.Println("Failed to write data to ssh stdin", err)
 				return
@@ -162,6 +298,8 @@ func doSshComm(conn net.Conn, p *ProxyItem) {
 		defer ss.Close()
 		defer client.Close()
 		defer conn.Close()
+		defer sess.close()
+		defer closeAgent()
 		err := ss.Shell()
 		if err != nil {
 			fmt.Println("Failed to start session", err)
@@ -192,9 +330,17 @@ func doTermConnect(resp http.ResponseWriter, r *http.Request, pid string) {
 		return
 	}
 
-	if p.TermType == "telnet" {
-		doTelnetComm(conn, p)
+	tc := newTermConn(conn)
+	if sid := r.FormValue("session"); sid != "" {
+		u := getReqUser(r)
+		doTermJoin(tc, p, sid, getReqUserName(r), r.FormValue("mode") != "rw", u == nil || u.roleLevel() >= ROLE_ADMIN)
+		return
+	}
+
+	_, _, termType := p.getTermTarget()
+	if termType == "telnet" {
+		doTelnetComm(tc, p, getReqUserName(r))
 	} else {
-		doSshComm(conn, p)
+		doSshComm(tc, p, getReqUserName(r))
 	}
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const SELF_SIGNED_VALID = 10 * 365 * 24 * time.Hour
+
+// resolve file relative to config dir
+func cfgPath(fileName string) string {
+	if fileName == "" || filepath.IsAbs(fileName) {
+		return fileName
+	}
+	return filepath.Join(filepath.Dir(cfg.cfgFile), fileName)
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// generate a self-signed certificate for localhost, hostname and local ips
+func genSelfSignedCert(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go-lcx " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SELF_SIGNED_VALID),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	for _, s := range iplist {
+		ip := net.ParseIP(s)
+		if ip != nil && !ip.IsLoopback() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificate found in %s", fileName)
+	}
+	return pool, nil
+}
+
+// tls config of the admin server, create self-signed cert on first start
+func getServerTlsConfig() (*tls.Config, error) {
+	certFile := cfgPath(cfg.certFile)
+	keyFile := cfgPath(cfg.keyFile)
+
+	if !fileExists(certFile) && !fileExists(keyFile) {
+		err := genSelfSignedCert(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		}
+		log.Println("Generated self-signed certificate", certFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.clientCa != "" {
+		pool, err := loadCertPool(cfgPath(cfg.clientCa))
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tc, nil
+}
+
+// tls config used by agent to connect controller with wss://
+func getAgentTlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.agentCa != "" {
+		pool, err := loadCertPool(cfg.agentCa)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+
+	if cfg.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.clientCert, cfg.clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
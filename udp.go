@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// default udp session idle timeout in seconds
+const DEFAULT_UDP_TIMEOUT int = 60
+
+// packets denied by acl are logged once per source in this interval
+const (
+	UDP_DENY_LOG_INTERVAL = time.Minute
+	UDP_DENY_LOG_MAX      = 1024 //sources remembered, others are only counted in metrics
+)
+
+var errUdpDenied = errors.New("denied by acl")
+
+type udpDenied struct {
+	logged  time.Time
+	dropped int //packets not logged since then
+}
+
+// udpSession is a client address with its own upstream socket
+type udpSession struct {
+	clientAddr net.Addr
+	remoteConn net.Conn
+	lastActive time.Time
+	conn       *proxyConn
+}
+
+type udpRelay struct {
+	pi         *ProxyItem
+	pc         net.PacketConn
+	remoteAddr string
+	timeout    time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*udpSession
+	closing  bool                  //stopping, no new session
+	denied   map[string]*udpDenied //source ip denied by acl
+}
+
+func (pi *ProxyItem) getUdpTimeout() time.Duration {
+	if pi.UdpTimeout <= 0 {
+		return time.Duration(DEFAULT_UDP_TIMEOUT) * time.Second
+	}
+	return time.Duration(pi.UdpTimeout) * time.Second
+}
+
+// get session of client, create one if not exist
+func (ur *udpRelay) getSession(clientAddr net.Addr) (*udpSession, error) {
+	key := clientAddr.String()
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	s, ok := ur.sessions[key]
+	if ok {
+		s.lastActive = time.Now()
+		return s, nil
+	}
+
+	if ur.closing {
+		ur.pi.stats.rejected.Add(1)
+		return nil, fmt.Errorf("proxy is stopping")
+	}
+
+	if !ur.pi.permitAcl(clientAddr) {
+		ur.logDenied(clientAddr)
+		return nil, errUdpDenied
+	}
+
+	ur.pi.stats.accepted.Add(1)
+	remoteConn, err := net.Dial("udp", ur.remoteAddr)
+	if err != nil {
+		ur.pi.stats.dialFailed.Add(1)
+		return nil, fmt.Errorf("failed to dial udp %s: %v", ur.remoteAddr, err)
+	}
+
+	s = &udpSession{clientAddr, remoteConn, time.Now(), ur.pi.addConn(clientAddr, nil, remoteConn)}
+	ur.sessions[key] = s
+	log.Println("New udp session", key, "to", remoteConn.RemoteAddr().String())
+
+	go ur.serveSession(s)
+	return s, nil
+}
+
+// log a denied source at most once per UDP_DENY_LOG_INTERVAL, with the packets dropped meanwhile
+func (ur *udpRelay) logDenied(addr net.Addr) {
+	ip, _, _ := net.SplitHostPort(addr.String())
+	now := time.Now()
+
+	d := ur.denied[ip]
+	if d != nil && now.Sub(d.logged) < UDP_DENY_LOG_INTERVAL {
+		d.dropped++
+		return
+	}
+
+	if d == nil {
+		if len(ur.denied) >= UDP_DENY_LOG_MAX {
+			for k, v := range ur.denied {
+				if now.Sub(v.logged) >= UDP_DENY_LOG_INTERVAL {
+					delete(ur.denied, k)
+				}
+			}
+			if len(ur.denied) >= UDP_DENY_LOG_MAX {
+				return
+			}
+		}
+		d = &udpDenied{}
+		ur.denied[ip] = d
+	}
+
+	if d.dropped > 0 {
+		log.Println("Denied", d.dropped, "more udp packets from", ip, "to proxy", ur.pi.Id, "in", now.Sub(d.logged).Round(time.Second))
+	}
+	log.Println("Denied udp packet from", addr.String(), "to proxy", ur.pi.Id, "by acl, logged once per", UDP_DENY_LOG_INTERVAL, "for each source")
+	d.logged = now
+	d.dropped = 0
+}
+
+func (ur *udpRelay) delSession(s *udpSession) {
+	key := s.clientAddr.String()
+
+	ur.lock.Lock()
+	if ur.sessions[key] == s {
+		delete(ur.sessions, key)
+	}
+	ur.lock.Unlock()
+
+	s.remoteConn.Close()
+	ur.pi.delConn(s.conn)
+	log.Println("Udp session", key, "closed")
+}
+
+// read from upstream, write back to client until idle timeout
+func (ur *udpRelay) serveSession(s *udpSession) {
+	defer ur.delSession(s)
+	var buf = make([]byte, 65535)
+
+	for {
+		s.remoteConn.SetReadDeadline(time.Now().Add(ur.timeout))
+		nbytes, err := s.remoteConn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				ur.lock.Lock()
+				idle := time.Since(s.lastActive)
+				ur.lock.Unlock()
+				if idle < ur.timeout {
+					continue
+				}
+				fmt.Println("Udp session", s.clientAddr.String(), "idle timeout")
+			} else {
+				fmt.Println("Udp session read error:", err)
+			}
+			return
+		}
+
+		ur.lock.Lock()
+		s.lastActive = time.Now()
+		ur.lock.Unlock()
+
+		_, err = ur.pc.WriteTo(buf[:nbytes], s.clientAddr)
+		if err != nil {
+			fmt.Println("Udp write to", s.clientAddr.String(), "error:", err)
+			return
+		}
+		s.conn.count(false, nbytes)
+	}
+}
+
+// stop creating new sessions, existing sessions keep working until drained
+func (ur *udpRelay) stopAccept() {
+	ur.lock.Lock()
+	ur.closing = true
+	ur.lock.Unlock()
+}
+
+func udpPacketRcvr(ur *udpRelay) {
+	var buf = make([]byte, 65535)
+
+	for {
+		nbytes, clientAddr, err := ur.pc.ReadFrom(buf)
+		if err != nil {
+			fmt.Println("Failed to read udp packet:", err)
+			break
+		}
+
+		s, err := ur.getSession(clientAddr)
+		if err == errUdpDenied {
+			continue
+		}
+		if err != nil {
+			fmt.Println("Failed to get udp session for", clientAddr.String(), err)
+			continue
+		}
+
+		_, err = s.remoteConn.Write(buf[:nbytes])
+		if err != nil {
+			fmt.Println("Udp write to", ur.remoteAddr, "error:", err)
+			continue
+		}
+		s.conn.count(true, nbytes)
+	}
+}
+
+func newUdpProxyServer(pi *ProxyItem, startResultCh chan opResult, reqTimestamp string) {
+	addr := pi.getLocalAddr()
+	var r = opResult{pi, reqTimestamp, nil}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		r.err = fmt.Errorf("failed to listen on udp %s: %v", addr, err)
+		startResultCh <- r
+		close(startResultCh)
+		return
+	}
+
+	ur := &udpRelay{
+		pi:         pi,
+		pc:         pc,
+		remoteAddr: pi.getRemoteAddr(),
+		timeout:    pi.getUdpTimeout(),
+		sessions:   make(map[string]*udpSession),
+		denied:     make(map[string]*udpDenied),
+	}
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		udpPacketRcvr(ur)
+	}()
+
+	log.Println("Started udp proxy:", pi)
+
+	startResultCh <- r
+	close(startResultCh)
+
+	waitProxyStop(pi)
+	ur.stopAccept()
+	pi.drainConns()
+	pc.Close()
+	wg.Wait()
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+func withUmask(mask int, f func() error) error {
+	return f()
+}
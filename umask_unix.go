@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// umask is process wide, changes of it are serialized
+var umaskLock sync.Mutex
+
+// run f with umask set to mask, then restore it
+func withUmask(mask int, f func() error) error {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
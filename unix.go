@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// remove socket file left by a previous run, refuse to remove a socket in use
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+
+	fmt.Println("Removing stale socket", path)
+	return os.Remove(path)
+}
+
+// socket is created accessible by owner only, then sockMode is applied,
+// so others can not connect before that
+func listenUnix(path string, sockMode string) (net.Listener, error) {
+	var mode uint64
+	var err error
+	if sockMode != "" {
+		mode, err = strconv.ParseUint(sockMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %s of %s: %v", sockMode, path, err)
+		}
+	}
+
+	err = removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var listener net.Listener
+	listen := func() error {
+		var err error
+		listener, err = net.Listen("unix", path)
+		return err
+	}
+	if sockMode == "" {
+		err = listen()
+	} else {
+		err = withUmask(0177, listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sockMode != "" {
+		err = os.Chmod(path, os.FileMode(mode))
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set mode %s on %s: %v", sockMode, path, err)
+		}
+	}
+
+	return listener, nil
+}
+
+func listenSock(protocol string, addr string, sockMode string) (net.Listener, error) {
+	if protocol == "unix" {
+		return listenUnix(addr, sockMode)
+	}
+
+	return net.Listen(protocol, addr)
+}
+
+// listen on local side of proxy, tcp or unix
+func listenLocal(pi *ProxyItem) (net.Listener, error) {
+	return listenSock(pi.Type, pi.getLocalAddr(), pi.SockMode)
+}
+
+// listen on remote side of proxy, used by listen mode
+func listenRemote(pi *ProxyItem) (net.Listener, error) {
+	return listenSock(pi.getRemoteType(), pi.getRemoteAddr(), pi.SockMode)
+}
+
+// close listener, remove the socket file for unix proxy
+func closeLocal(protocol string, addr string, listener net.Listener) {
+	listener.Close()
+	if protocol == "unix" {
+		os.Remove(addr)
+	}
+}
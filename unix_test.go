@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lcx.sock")
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	l, err := listenUnix(path, "660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeLocal("unix", path, l)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Fatalf("mode %o, want 660", fi.Mode().Perm())
+	}
+	if mask := syscall.Umask(0); mask != 0 {
+		t.Fatalf("umask %o not restored", mask)
+	}
+
+	_, err = listenUnix(filepath.Join(t.TempDir(), "x.sock"), "8")
+	if err == nil {
+		t.Fatal("invalid mode accepted")
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watch the directory of fileName, call onChange when the file is written or replaced
+func watchFile(fileName string, onChange func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fileName)
+	base := filepath.Base(fileName)
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		var buf = make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				log.Println("Failed to read inotify events:", err)
+				return
+			}
+
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameStart := off + syscall.SizeofInotifyEvent
+				name := string(bytes.TrimRight(buf[nameStart:nameStart+int(ev.Len)], "\x00"))
+				off = nameStart + int(ev.Len)
+
+				if name == base {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func watchFile(fileName string, onChange func()) error {
+	return fmt.Errorf("file watching is not supported, use SIGHUP to reload")
+}
@@ -1,22 +1,164 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
+// control message types of web terminal
+const (
+	TERM_CTRL_RESIZE  = "resize"
+	TERM_CTRL_SESSION = "session" //server to client, session and its observers
+	TERM_CTRL_GRANT   = "grant"   //owner to server, allow or deny input of an observer
+)
+
+// termCtrl is a control message of web terminal, it is sent in binary frames
+// as json, while text frames are terminal data
+type termCtrl struct {
+	Type    string
+	Cols    int          `json:",omitempty"`
+	Rows    int          `json:",omitempty"`
+	Session *TermSession `json:",omitempty"`
+
+	Observer int  `json:",omitempty"`
+	Allow    bool `json:",omitempty"`
+}
+
+// termConn is the websocket of a web terminal, control messages are handled
+// while reading data, window size is remembered for the session started later
+type termConn struct {
+	net.Conn
+	lock     sync.Mutex
+	wlock    sync.Mutex //frames are written by output, stderr and control senders
+	cols     int
+	rows     int
+	onResize func(cols int, rows int)
+	onCtrl   func(c *termCtrl) //other control messages, nil drops them
+}
+
+func newTermConn(conn net.Conn) *termConn {
+	return &termConn{Conn: conn, cols: 120, rows: 40}
+}
+
+func (tc *termConn) size() (int, int) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.cols, tc.rows
+}
+
+func (tc *termConn) setResizeHandler(f func(cols int, rows int)) {
+	tc.lock.Lock()
+	tc.onResize = f
+	tc.lock.Unlock()
+}
+
+func (tc *termConn) resizeHandler() func(cols int, rows int) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.onResize
+}
+
+func (tc *termConn) setCtrlHandler(f func(c *termCtrl)) {
+	tc.lock.Lock()
+	tc.onCtrl = f
+	tc.lock.Unlock()
+}
+
+func (tc *termConn) writeText(p []byte) error {
+	tc.wlock.Lock()
+	defer tc.wlock.Unlock()
+	return wsutil.WriteServerText(tc.Conn, p)
+}
+
+func (tc *termConn) writeCtrl(c *termCtrl) error {
+	j, _ := json.Marshal(c)
+	tc.wlock.Lock()
+	defer tc.wlock.Unlock()
+	return wsutil.WriteServerBinary(tc.Conn, j)
+}
+
+// read next data frame from client, control frames before it are handled
+func (tc *termConn) readData() ([]byte, error) {
+	for {
+		msg, op, err := wsutil.ReadClientData(tc.Conn)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.debug {
+			fmt.Println("Received ws data, op", op, "msg", msg)
+		}
+
+		if op == ws.OpBinary {
+			tc.handleCtrl(msg)
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func (tc *termConn) handleCtrl(msg []byte) {
+	var c termCtrl
+	err := json.Unmarshal(msg, &c)
+	if err != nil {
+		fmt.Println("Invalid terminal control message", string(msg), err)
+		return
+	}
+
+	switch c.Type {
+	case TERM_CTRL_RESIZE:
+		if c.Cols <= 0 || c.Rows <= 0 || c.Cols > 65535 || c.Rows > 65535 {
+			fmt.Println("Invalid terminal size", c.Cols, c.Rows)
+			return
+		}
+		tc.lock.Lock()
+		tc.cols, tc.rows = c.Cols, c.Rows
+		f := tc.onResize
+		tc.lock.Unlock()
+		if f != nil {
+			f(c.Cols, c.Rows)
+		}
+	default:
+		tc.lock.Lock()
+		f := tc.onCtrl
+		tc.lock.Unlock()
+		if f == nil {
+			fmt.Println("Unknown terminal control message", c.Type)
+			return
+		}
+		f(&c)
+	}
+}
+
+// wsio reads input of session owner and writes output to all clients of session
 type wsio struct {
-	conn     net.Conn
+	sess     *termSession
 	isStdErr bool
+	pending  []byte //incomplete utf-8 tail of last write
+}
+
+// split incomplete utf-8 rune at the end of data, text frames must be valid utf-8
+func cutUtf8Tail(data []byte) ([]byte, []byte) {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i], slices.Clone(data[i:])
+			}
+			break
+		}
+	}
+	return data, nil
 }
 
 func (ws *wsio) Read(p []byte) (n int, err error) {
-	r, err := wsutil.ReadClientText(ws.conn)
+	r, err := ws.sess.conn.readData()
 	if err != nil {
 		fmt.Println("Failed to read data from ws", err)
 		return 0, err
@@ -40,7 +182,13 @@ func (ws *wsio) Read(p []byte) (n int, err error) {
 }
 
 func (ws *wsio) Write(p []byte) (n int, err error) {
-	err = wsutil.WriteServerText(ws.conn, p)
+	var data []byte
+	data, ws.pending = cutUtf8Tail(append(ws.pending, p...))
+	if len(data) == 0 {
+		return len(p), nil
+	}
+
+	err = ws.sess.output(data)
 	if err != nil {
 		fmt.Println("Failed to write data", p, "to ws", err, "is stderr", ws.isStdErr)
 		return 0, err
@@ -58,55 +206,53 @@ func (ws *wsio) Write(p []byte) (n int, err error) {
 	return len(p), err
 }
 
-func getWsEcho(conn io.ReadWriter, write string) (string, error) {
-	wmsg := []byte(write)
-	var op = ws.OpText
-	var rcvstr string = ""
+func getWsEcho(conn *termConn, write string) (string, error) {
+	return getWsInput(conn, write, write != PROMPT_PASSWORD)
+}
 
-	err := wsutil.WriteServerMessage(conn, op, wmsg)
+// write prompt then read a line from terminal, echo it back if echo
+func getWsInput(conn *termConn, prompt string, echo bool) (string, error) {
+	err := wsutil.WriteServerMessage(conn, ws.OpText, []byte(prompt))
 	if err != nil {
-		// handle error
-		fmt.Println("Failed to write ws data", write, err)
+		fmt.Println("Failed to write ws data", prompt, err)
 		return "", err
 	}
 
-	var echo = true
-	var got_line_feed = false
-
-	switch write {
-	case PROMPT_PASSWORD:
-		echo = false
-	}
-
+	var line []rune
 	for {
-		rmsg, op, err := wsutil.ReadClientData(conn)
+		rmsg, err := conn.readData()
 		if err != nil {
-			// handle error
 			fmt.Println("Failed to read ws data", err)
 			return "", err
-		} else {
-			if cfg.debug {
-				fmt.Println("Received ws data, op", op, "msg", rmsg)
-			}
-			if rmsg[0] == '\r' || rmsg[0] == '\n' {
-				got_line_feed = true
-			} else {
-				rcvstr += string(rmsg)
-			}
-			if echo {
-				err = wsutil.WriteServerMessage(conn, op, rmsg)
-				if err != nil {
-					fmt.Println("Failed to send echo data", rmsg)
+		}
+
+		var out []byte
+		for _, c := range string(rmsg) {
+			switch c {
+			case '\r', '\n':
+				if !echo {
+					out = nil
 				}
+				err = wsutil.WriteServerMessage(conn, ws.OpText, append(out, "\r\n"...))
+				return string(line), err
+			case 0x7f, '\b':
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					out = append(out, "\b \b"...)
+				}
+			default:
+				line = append(line, c)
+				out = append(out, string(c)...)
 			}
+		}
 
-			if got_line_feed {
-				break
+		if echo && len(out) > 0 {
+			err = wsutil.WriteServerMessage(conn, ws.OpText, out)
+			if err != nil {
+				fmt.Println("Failed to send echo data", out)
 			}
 		}
 	}
-
-	return rcvstr, nil
 }
 
 func doWsComm(resp http.ResponseWriter, req *http.Request) {